@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//indexName is file in target directory where every downloaded file is noted with its hash
+const indexName = "index.json"
+
+//archive knows what is already in target directory. It is nil when nothing is downloaded, all methods are fine with that
+var archive *archiveIndex
+
+//indexEntry is single file in target directory
+type indexEntry struct {
+	ID     int    `json:"id,omitempty"`
+	File   string `json:"file"`                //Relative to target directory, with forward slashes
+	Size   int64  `json:"size"`                //On disk, with embedded metadata if there is any
+	SHA256 string `json:"sha256"`              //Of file as it came from server. Embedded metadata is taken out before hashing
+	DHash  string `json:"dhash,omitempty"`     //Perceptual hash, for pictures only
+	Orig   int64  `json:"orig_size,omitempty"` //Size of file as it came from server, if it differs from size on disk
+}
+
+type archiveIndex struct {
+	mu     sync.Mutex
+	dir    string
+	link   string //How duplicates are linked, empty if they are left as they are
+	files  map[string]indexEntry
+	byHash map[string]string //Hash to file that was there first
+	dirty  bool
+}
+
+func newArchive(dir, link string) *archiveIndex {
+	return &archiveIndex{dir: dir, link: link, files: make(map[string]indexEntry), byHash: make(map[string]string)}
+}
+
+//openArchive reads index of target directory, if there is any
+func openArchive(dir, link string) (*archiveIndex, error) {
+	a := newArchive(dir, link)
+	raw, err := ioutil.ReadFile(constructFilepath(indexName, dir))
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []indexEntry
+	if err = json.Unmarshal(raw, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		a.put(e)
+	}
+	return a, nil
+}
+
+//put notes entry. Lock must be held
+func (a *archiveIndex) put(e indexEntry) {
+	if old, ok := a.files[e.File]; ok && a.byHash[old.SHA256] == e.File {
+		delete(a.byHash, old.SHA256) //File was overwritten with something else
+	}
+	a.files[e.File] = e
+	if _, ok := a.byHash[e.SHA256]; !ok {
+		a.byHash[e.SHA256] = e.File
+	}
+	a.dirty = true
+}
+
+//original finds file with the same content as given one, that is still on disk
+func (a *archiveIndex) original(hash, file string) (string, bool) {
+	orig, ok := a.byHash[hash]
+	if !ok || orig == file {
+		return "", false
+	}
+	if getFileSize(filepath.Join(a.dir, filepath.FromSlash(orig))) != a.files[orig].Size { //Removed or changed behind our back
+		delete(a.byHash, hash)
+		return "", false
+	}
+	return orig, true
+}
+
+//added notes freshly downloaded file. If the same bytes are already in archive and linking is on,
+//file is replaced with link to them
+func (a *archiveIndex) added(id int, path string, size int64, hash string) {
+	if a == nil {
+		return
+	}
+	rel := archivePath(a.dir, path)
+	dhash := lookAt(path) //Before taking lock, decoding takes a while
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.link != "" {
+		if orig, ok := a.original(hash, rel); ok {
+			origPath := filepath.Join(a.dir, filepath.FromSlash(orig))
+			if same, err := sameContent(origPath, path); err != nil || !same { //Hash is of what server gave, metadata embedded since differs
+				lDetailw("Same as "+orig+", but with metadata of its own, not linked", logFields{"image_id": id, "file": rel, "original": orig})
+			} else if err = linkFile(a.link, origPath, path); err != nil {
+				lWarn("Could not link", rel, "to", orig, "keeping it as it is:", err)
+			} else {
+				lDetailw("Same as "+orig+", linked", logFields{"image_id": id, "file": rel, "original": orig})
+			}
+		}
+	}
+
+	e := indexEntry{ID: id, File: rel, Size: getFileSize(path), SHA256: hash, DHash: dhash} //Size of whatever is there after linking
+	if e.Size != size {
+		e.Orig = size
+	}
+	a.put(e)
+}
+
+//lookAt is perceptual hash of file as index keeps it, empty if file is not a picture
+func lookAt(path string) string {
+	if !canDHash(path) {
+		return ""
+	}
+	h, err := fileDHash(path)
+	if err != nil {
+		lDetailw("Could not look at image", logFields{"file": path, "error": err})
+		return ""
+	}
+	return formatDHash(h)
+}
+
+//origSize is size of file as it came from server, if metadata was embedded into it since. Otherwise it's 0
+func (a *archiveIndex) origSize(path string) int64 {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.files[archivePath(a.dir, path)]
+	if !ok || e.Orig == 0 || getFileSize(path) != e.Size {
+		return 0
+	}
+	return e.Orig
+}
+
+//hash is SHA-256 of file as it came from server, if file is the same as when it was noted. Otherwise it's empty
+func (a *archiveIndex) hash(path string) string {
+	if a == nil {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.files[archivePath(a.dir, path)]
+	if !ok || getFileSize(path) != e.Size {
+		return ""
+	}
+	return e.SHA256
+}
+
+//removed forgets file
+func (a *archiveIndex) removed(path string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rel := archivePath(a.dir, path)
+	if e, ok := a.files[rel]; ok {
+		if a.byHash[e.SHA256] == rel {
+			delete(a.byHash, e.SHA256)
+		}
+		delete(a.files, rel)
+		a.dirty = true
+	}
+}
+
+//close writes index down, if anything changed
+func (a *archiveIndex) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.dirty {
+		return nil
+	}
+	return a.save()
+}
+
+//save writes index into file. Lock must be held
+func (a *archiveIndex) save() error {
+	entries := make([]indexEntry, 0, len(a.files))
+	for _, e := range a.files {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].File < entries[j].File })
+
+	raw, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := constructFilepath(indexName, a.dir)
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path) //Old index stays whole until new one is ready
+}
+
+//archivePath turns path of file in target directory into the way index keeps it
+func archivePath(dir, path string) string {
+	if dir == "" {
+		dir = "."
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		rel = path
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//defaultAspectTolerance is used when aspect ratio was given without explicit tolerance.
+//Derpibooru rounds aspect ratio, so exact comparison would miss most of images
+const defaultAspectTolerance = 0.01
+
+//Aspect is width to height ratio with allowed deviation, passed as "16:9", "1.5" or "16:9±0.02"
+type Aspect struct {
+	Ratio     float64
+	Tolerance float64
+}
+
+//UnmarshalFlag implements flags.Unmarshaler interface for Aspect
+func (a *Aspect) UnmarshalFlag(value string) error {
+	bad := fmt.Errorf("`%s' is not an aspect ratio, try \"16:9\" or \"16:9±0.02\"", value)
+
+	ratio, tol := value, ""
+	for _, sep := range []string{"±", "+-", "~"} { //Not everyone got ± on their keyboard
+		if i := strings.Index(value, sep); i >= 0 {
+			ratio, tol = value[:i], value[i+len(sep):]
+			break
+		}
+	}
+
+	a.Tolerance = defaultAspectTolerance
+	if tol != "" {
+		t, err := strconv.ParseFloat(strings.TrimSpace(tol), 64)
+		if err != nil || t < 0 {
+			return bad
+		}
+		a.Tolerance = t
+	}
+
+	parts := strings.Split(ratio, ":")
+	switch len(parts) {
+	case 1:
+		r, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil || r <= 0 {
+			return bad
+		}
+		a.Ratio = r
+	case 2:
+		w, errw := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		h, errh := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if errw != nil || errh != nil || w <= 0 || h <= 0 {
+			return bad
+		}
+		a.Ratio = w / h
+	default:
+		return bad
+	}
+	return nil
+}
+
+//MarshalFlag implements flags.Marshaler interface for Aspect
+func (a Aspect) MarshalFlag() (string, error) {
+	if a.Ratio == 0 {
+		return "", nil
+	}
+	return strconv.FormatFloat(a.Ratio, 'f', -1, 64) + "±" + strconv.FormatFloat(a.Tolerance, 'f', -1, 64), nil
+}
+
+//matches checks if width and height fit into given ratio. Images of unknown size never fit
+func (a Aspect) matches(width, height int) bool {
+	if width <= 0 || height <= 0 {
+		return false
+	}
+	return math.Abs(float64(width)/float64(height)-a.Ratio) <= a.Tolerance
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//catalogueName is file in target directory where everything we know about downloaded images is kept, one JSON per line.
+//It is only appended to, later lines about the same image win
+const catalogueName = "catalogue.jsonl"
+
+//categoriesName is file in target directory with categories of tags, as Derpibooru sorts them
+const categoriesName = "tags.json"
+
+//tagsPerLookup is how many tags are asked about in one search, as much as single page of results holds
+const tagsPerLookup = 50
+
+//catalogue remembers what downloaded images are, so they could be exported without asking Derpibooru again.
+//It is nil when nothing is downloaded into target directory, all methods are fine with that
+var catalogue *imageCatalogue
+
+//catalogueEntry is single image, with all files it brought
+type catalogueEntry struct {
+	ID          int       `json:"id"`
+	Files       []string  `json:"files"`
+	Tags        []string  `json:"tags"`
+	Source      string    `json:"source,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Format      string    `json:"format"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Score       int       `json:"score"`
+	Faves       int       `json:"faves"`
+	Created     time.Time `json:"created_at"`
+}
+
+type imageCatalogue struct {
+	mu         sync.Mutex
+	dir        string
+	out        *os.File
+	entries    map[int]catalogueEntry
+	order      []int
+	categories map[string]string //Empty category is tag Derpibooru doesn't sort anywhere
+	dirty      bool              //Categories changed
+}
+
+//openCatalogue reads what was downloaded before and gets ready to note new images
+func openCatalogue(dir string) (*imageCatalogue, error) {
+	c, err := readCatalogue(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.out, err = os.OpenFile(constructFilepath(catalogueName, dir), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//readCatalogue reads catalogue of target directory, read-only. No catalogue is empty catalogue
+func readCatalogue(dir string) (*imageCatalogue, error) {
+	c := &imageCatalogue{dir: dir, entries: make(map[int]catalogueEntry), categories: make(map[string]string)}
+
+	raw, err := ioutil.ReadFile(constructFilepath(categoriesName, dir))
+	if err == nil {
+		err = json.Unmarshal(raw, &c.categories)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	in, err := os.Open(constructFilepath(catalogueName, dir))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close() //Read-only, nothing to lose
+
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, 1<<20) //Some images have a lot of tags
+	for sc.Scan() {
+		var e catalogueEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			lWarn("Skipping broken line in", catalogueName)
+			continue
+		}
+		c.put(e)
+	}
+	return c, sc.Err()
+}
+
+//put notes entry. Lock must be held, if anyone else could be there
+func (c *imageCatalogue) put(e catalogueEntry) {
+	if _, ok := c.entries[e.ID]; !ok {
+		c.order = append(c.order, e.ID)
+	}
+	c.entries[e.ID] = e
+}
+
+//splitTags turns tags as API gives them into list
+func splitTags(tags string) []string {
+	var res []string
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+//noted remembers image that is now in target directory. File is added to ones image already has.
+//Line is written only when something about image changed, so runs that find everything in place don't grow catalogue
+func (c *imageCatalogue) noted(img Image) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := catalogueEntry{ID: img.Imgid, Tags: splitTags(img.Tags), Source: img.Source, Description: img.Description, Format: img.Format,
+		Width: img.Width, Height: img.Height, Score: img.Score, Faves: img.Faves, Created: img.Created}
+	e.Files = append(e.Files, c.entries[img.Imgid].Files...)
+	known := false
+	for _, f := range e.Files {
+		known = known || f == img.Filename
+	}
+	if !known {
+		e.Files = append(e.Files, img.Filename)
+	}
+
+	line, err := json.Marshal(e)
+	if old, ok := c.entries[img.Imgid]; ok && err == nil {
+		if was, werr := json.Marshal(old); werr == nil && bytes.Equal(was, line) {
+			return
+		}
+	}
+	c.put(e)
+	if err == nil {
+		_, err = c.out.Write(append(line, '\n'))
+	}
+	if err != nil {
+		lErr("Could not note image in catalogue: ", err)
+	}
+}
+
+//list is all entries, in order they were first noted
+func (c *imageCatalogue) list() []catalogueEntry {
+	res := make([]catalogueEntry, 0, len(c.order))
+	for _, id := range c.order {
+		res = append(res, c.entries[id])
+	}
+	return res
+}
+
+//category of tag. Namespaced tags, like artist:somepony, are sorted by namespace, no need to ask anyone about them
+func (c *imageCatalogue) category(tag string) (cat string, known bool) {
+	if i := strings.Index(tag, ":"); i > 0 {
+		return tag[:i], true
+	}
+	cat, known = c.categories[tag]
+	return
+}
+
+//uncategorized are tags of images in catalogue we don't know category of, sorted
+func (c *imageCatalogue) uncategorized() []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, e := range c.entries {
+		for _, t := range e.Tags {
+			if _, known := c.category(t); !known && !seen[t] {
+				seen[t] = true
+				res = append(res, t)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+//categorize asks Derpibooru about categories of tags we don't know yet. It's done once for every tag,
+//so later exports could be done without any network
+func (c *imageCatalogue) categorize(ctx context.Context, key string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tags := c.uncategorized()
+	for len(tags) != 0 && ctx.Err() == nil {
+		n := tagsPerLookup
+		if n > len(tags) {
+			n = len(tags)
+		}
+		found, err := lookupCategories(ctx, tags[:n], key)
+		if err != nil {
+			return err
+		}
+		for _, t := range tags[:n] {
+			c.categories[t] = found[t] //Not found is the same as uncategorized, no use asking again
+		}
+		c.dirty = true
+		tags = tags[n:]
+	}
+	return nil
+}
+
+//lookupCategories searches for given tags by name, all at once
+func lookupCategories(ctx context.Context, tags []string, key string) (map[string]string, error) {
+	names := make([]string, 0, len(tags))
+	for _, t := range tags {
+		names = append(names, "name:"+strconv.Quote(t))
+	}
+	q := url.Values{"q": {strings.Join(names, " || ")}, "per_page": {strconv.Itoa(tagsPerLookup)}}
+	body, err := getJSON(ctx, apiURL(derpiURL, "/api/v1/json/search/tags", q, key))
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Tags []struct {
+			Name     string `json:"name"`
+			Category string `json:"category"`
+		} `json:"tags"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	found := make(map[string]string, len(res.Tags))
+	for _, t := range res.Tags {
+		found[t.Name] = t.Category
+	}
+	return found, nil
+}
+
+//close finishes catalogue and writes down categories, if we learned any
+func (c *imageCatalogue) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.out.Close(); err != nil {
+		return err
+	}
+	if !c.dirty {
+		return nil
+	}
+	raw, err := json.MarshalIndent(c.categories, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := constructFilepath(categoriesName, c.dir)
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
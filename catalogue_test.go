@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCatalogue(t *testing.T) {
+	var asked []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.URL.Query().Get("q"))
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"tags": []map[string]interface{}{
+			{"name": "princess luna", "category": "character"},
+			{"name": "alicorn", "category": "species"},
+			{"name": "safe", "category": "rating"},
+			{"name": "smiling", "category": nil},
+		}})
+	}))
+	defer ts.Close()
+	saved := derpiURL
+	defer func() { derpiURL = saved }()
+	u, _ := url.Parse(ts.URL)
+	derpiURL.Scheme, derpiURL.Host = u.Scheme, u.Host
+
+	dir := t.TempDir()
+	c, err := openCatalogue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.noted(Image{Imgid: 1, Filename: "1.svg", Tags: "princess luna, alicorn, artist:somepony, safe"})
+	c.noted(Image{Imgid: 1, Filename: "1.png", Tags: "princess luna, alicorn, artist:somepony, safe, smiling", Width: 100})
+	c.noted(Image{Imgid: 1, Filename: "1.png", Tags: "princess luna, alicorn, artist:somepony, safe, smiling", Width: 100})
+	if err = c.categorize(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 1 || strings.Contains(asked[0], "artist") || !strings.Contains(asked[0], `name:"princess luna" || `) {
+		t.Error("Wrong lookups: ", asked)
+	}
+	if err = c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = openCatalogue(dir) //Next run finds the same image in place
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.noted(Image{Imgid: 1, Filename: "1.png", Tags: "princess luna, alicorn, artist:somepony, safe, smiling", Width: 100})
+	_ = c.close()
+	if raw, _ := ioutil.ReadFile(filepath.Join(dir, catalogueName)); strings.Count(string(raw), "\n") != 2 {
+		t.Errorf("Unchanged image noted again:\n%s", raw)
+	}
+
+	c, err = readCatalogue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := c.list()
+	if len(list) != 1 || strings.Join(list[0].Files, ",") != "1.svg,1.png" || len(list[0].Tags) != 5 || list[0].Width != 100 {
+		t.Errorf("Wrong catalogue: %+v", list)
+	}
+	if cat, known := c.category("alicorn"); cat != "species" || !known {
+		t.Error("Category was forgotten: ", cat)
+	}
+	if cat, known := c.category("smiling"); cat != "" || !known {
+		t.Error("General tag is not known as such: ", cat)
+	}
+	if tags := c.uncategorized(); len(tags) != 0 {
+		t.Error("Still don't know about ", tags)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//checkpointName is file in target directory where progress of search is kept, so it could be resumed
+const checkpointName = "checkpoint.json"
+
+//Order search results are asked in, newest first. Resuming relies on it: new uploads only push older images further.
+//It's sent with every page, or server and user's filter would decide it
+const (
+	searchField     = "created_at"
+	searchDirection = "desc"
+	searchSort      = searchField + " " + searchDirection
+)
+
+//checkpoint follows search while it goes. It is nil when there is no search to follow, all methods are fine with that
+var checkpoint *crawlCheckpoint
+
+//checkpointState is what gets written on disk. Search is resumed from Page of window from Since up to Before,
+//skipping images with ID of LastID or above, those were done already, and images in Done, finished out of order
+type checkpointState struct {
+	Query   string    `json:"query"`
+	Sort    string    `json:"sort"`
+	Since   time.Time `json:"since,omitempty"`
+	Before  time.Time `json:"before,omitempty"`
+	Page    int       `json:"page"`
+	LastID  int       `json:"last_id,omitempty"`
+	Done    []int     `json:"done,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+//fetchedPage is page of search that was handed over to downloader, and how many of its images are still in work
+type fetchedPage struct {
+	w      window
+	page   int
+	left   int
+	lastID int
+}
+
+type crawlCheckpoint struct {
+	mu      sync.Mutex
+	path    string
+	state   checkpointState
+	pages   []*fetchedPage       //In order they were fetched, completed ones are cut off from the front
+	idPage  map[int]*fetchedPage //Which page image came from
+	idLeft  map[int]int          //How many files of image are still in work
+	done    map[int]bool         //Images finished while their page is still in work
+	crawled bool                 //Search went through all pages
+
+	skipFrom int //When resuming, everything from this ID up was done before
+	skipIDs  map[int]bool
+}
+
+//newCheckpoint starts following search for tag. If resume is given, images it notes as done are skipped.
+//Dry run only skips, without writing anything
+func newCheckpoint(dir, tag string, resume *checkpointState, dryRun bool) *crawlCheckpoint {
+	c := &crawlCheckpoint{
+		path:    constructFilepath(checkpointName, dir),
+		state:   checkpointState{Query: tag, Sort: searchSort},
+		idPage:  make(map[int]*fetchedPage),
+		idLeft:  make(map[int]int),
+		done:    make(map[int]bool),
+		skipIDs: make(map[int]bool),
+	}
+	if dryRun {
+		c.path = ""
+	}
+	if resume != nil {
+		c.state = *resume
+		c.skipFrom = resume.LastID
+		for _, id := range resume.Done {
+			c.skipIDs[id] = true
+			c.done[id] = true
+		}
+	}
+	return c
+}
+
+//loadCheckpoint reads checkpoint left by previous run in target directory
+func loadCheckpoint(dir string) (*checkpointState, error) {
+	raw, err := ioutil.ReadFile(constructFilepath(checkpointName, dir))
+	if err != nil {
+		return nil, err
+	}
+	var st checkpointState
+	if err = json.Unmarshal(raw, &st); err != nil {
+		return nil, err
+	}
+	if st.Sort != searchSort {
+		return nil, fmt.Errorf("checkpoint is for search sorted by %s, can't resume it", st.Sort)
+	}
+	return &st, nil
+}
+
+//seen tells if image was done before we resumed, so it should not be sent again
+func (c *crawlCheckpoint) seen(id int) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return (c.skipFrom != 0 && id >= c.skipFrom) || c.skipIDs[id]
+}
+
+//fetched notes page of search, with all images it brought, before they are sent further.
+//Images already noted on earlier page stay there, they are not sent twice
+func (c *crawlCheckpoint) fetched(w window, page int, imgs []Image) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var fresh []Image
+	for _, img := range imgs {
+		if _, ok := c.idPage[img.Imgid]; !ok {
+			fresh = append(fresh, img)
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	p := &fetchedPage{w: w, page: page, left: len(fresh), lastID: fresh[0].Imgid}
+	for _, img := range fresh {
+		c.idPage[img.Imgid] = p
+		c.idLeft[img.Imgid]++
+		if img.Imgid < p.lastID {
+			p.lastID = img.Imgid
+		}
+	}
+	c.pages = append(c.pages, p)
+	if len(c.pages) == 1 && c.state.Page == 0 { //Nothing was completed yet, so this is where we would start over
+		c.state.Since, c.state.Before, c.state.Page = w.since, w.before, page
+	}
+	c.save()
+}
+
+//completed notes that image is done with, whatever happened to it
+func (c *crawlCheckpoint) completed(img Image) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.idPage[img.Imgid]
+	if !ok {
+		return //Not from search, or from search before we resumed
+	}
+	p.left--
+	c.idLeft[img.Imgid]--
+	if c.idLeft[img.Imgid] <= 0 { //Image with alternates is done when all of them are
+		c.done[img.Imgid] = true
+	}
+
+	for len(c.pages) != 0 && c.pages[0].left <= 0 { //Pages are done in order they were fetched, mostly
+		p = c.pages[0]
+		c.pages = c.pages[1:]
+		c.state.Since, c.state.Before, c.state.Page, c.state.LastID = p.w.since, p.w.before, p.page, p.lastID
+		for id, pp := range c.idPage {
+			if pp == p {
+				delete(c.idPage, id)
+				delete(c.idLeft, id)
+				delete(c.done, id)
+			}
+		}
+	}
+	c.save()
+}
+
+//finishedSearch notes that search went through all pages without problems
+func (c *crawlCheckpoint) finishedSearch() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.crawled = true
+	c.mu.Unlock()
+}
+
+//close removes checkpoint if search is over and all images are done, there is nothing to resume then
+func (c *crawlCheckpoint) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crawled && len(c.pages) == 0 && c.path != "" {
+		err := os.Remove(c.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+//save writes checkpoint down. Lock must be held
+func (c *crawlCheckpoint) save() {
+	if c.path == "" {
+		return
+	}
+	c.state.Done = c.state.Done[:0]
+	for id := range c.done {
+		if c.state.LastID == 0 || id < c.state.LastID { //The rest is covered by LastID
+			c.state.Done = append(c.state.Done, id)
+		}
+	}
+	sort.Ints(c.state.Done)
+	c.state.Updated = time.Now()
+
+	raw, err := json.MarshalIndent(c.state, "", "  ")
+	if err == nil {
+		tmp := c.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, raw, 0600); err == nil {
+			err = os.Rename(tmp, c.path) //Half-written checkpoint is worse than a bit older one
+		}
+	}
+	if err != nil {
+		lErr("Could not write checkpoint: ", err)
+	}
+}
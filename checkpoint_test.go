@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestCheckpointProgress(t *testing.T) {
+	dir := t.TempDir()
+	c := newCheckpoint(dir, "safe", nil, false)
+
+	c.fetched(window{}, 1, []Image{{Imgid: 10}, {Imgid: 9}})
+	c.fetched(window{}, 2, []Image{{Imgid: 8}, {Imgid: 7}})
+	c.completed(Image{Imgid: 10})
+	c.completed(Image{Imgid: 8})
+
+	st, err := loadCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Query != "safe" || st.Page != 1 || st.LastID != 0 || len(st.Done) != 2 {
+		t.Error("Checkpoint before first page is done is wrong: ", st)
+	}
+
+	c.completed(Image{Imgid: 9})
+	if st, _ = loadCheckpoint(dir); st.Page != 1 || st.LastID != 9 || len(st.Done) != 1 || st.Done[0] != 8 {
+		t.Error("Checkpoint after first page is done is wrong: ", st)
+	}
+
+	resumed := newCheckpoint(dir, "safe", st, false)
+	for id, seen := range map[int]bool{11: true, 9: true, 8: true, 7: false} {
+		if resumed.seen(id) != seen {
+			t.Error("Resumed checkpoint thinks image ", id, " seen is ", !seen)
+		}
+	}
+
+	c.completed(Image{Imgid: 7})
+	c.finishedSearch()
+	if err = c.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadCheckpoint(dir); err == nil {
+		t.Error("Checkpoint of finished search is left behind")
+	}
+}
+
+func TestShiftedSearch(t *testing.T) {
+	//Hundred images were there when we started, three more were uploaded after first page
+	var ids []int
+	for id := 100; id > 0; id-- {
+		ids = append(ids, id)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 2 && ids[0] == 100 {
+			ids = append([]int{103, 102, 101}, ids...)
+		}
+		var s Search
+		s.Total = len(ids)
+		for i := (page - 1) * 10; i < page*10 && i < len(ids); i++ {
+			s.Images = append(s.Images, RawImage{Imgid: ids[i]})
+		}
+		_ = json.NewEncoder(w).Encode(s)
+	}))
+	defer ts.Close()
+
+	saved, savedCheckpoint := derpiURL, checkpoint
+	defer func() { derpiURL, checkpoint = saved, savedCheckpoint }()
+	u, _ := url.Parse(ts.URL)
+	derpiURL.Scheme, derpiURL.Host = u.Scheme, u.Host
+
+	dir := t.TempDir()
+	checkpoint = newCheckpoint(dir, "safe", nil, false)
+	imgchan := make(chan Image, 200)
+	ParseTag(context.Background(), imgchan, &TagOpts{Tag: "safe", StartPage: 1, StopPage: 0}, &FiltOpts{}, "")
+
+	got := make(map[int]bool)
+	for img := range imgchan {
+		if got[img.Imgid] {
+			t.Error("Image sent twice: ", img.Imgid)
+		}
+		got[img.Imgid] = true
+		checkpoint.completed(img)
+	}
+	if len(got) != 100 {
+		t.Error("Wrong number of images: ", len(got))
+	}
+	if err := checkpoint.close(); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := loadCheckpoint(dir); err == nil {
+		t.Error("Checkpoint of finished search is left behind: ", st)
+	}
+}
+
+func TestResumeShiftedSearch(t *testing.T) {
+	//Hundred images were there when we started, three more were uploaded since
+	var ids []int
+	for id := 103; id > 0; id-- {
+		ids = append(ids, id)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sf") != "created_at" || r.URL.Query().Get("sd") != "desc" {
+			http.Error(w, "unknown order", http.StatusBadRequest)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		var s Search
+		s.Total = len(ids)
+		for i := (page - 1) * 10; i < page*10 && i < len(ids); i++ {
+			s.Images = append(s.Images, RawImage{Imgid: ids[i]})
+		}
+		_ = json.NewEncoder(w).Encode(s)
+	}))
+	defer ts.Close()
+
+	saved, savedCheckpoint := derpiURL, checkpoint
+	defer func() { derpiURL, checkpoint = saved, savedCheckpoint }()
+	u, _ := url.Parse(ts.URL)
+	derpiURL.Scheme, derpiURL.Host = u.Scheme, u.Host
+
+	//Stopped after second page, with one image of third done
+	st := &checkpointState{Query: "safe", Sort: searchSort, Page: 2, LastID: 81, Done: []int{79}}
+	checkpoint = newCheckpoint(t.TempDir(), "safe", st, false)
+
+	imgchan := make(chan Image, len(ids))
+	ParseTag(context.Background(), imgchan, &TagOpts{Tag: "safe", StartPage: 1, resume: st}, &FiltOpts{}, "")
+
+	var got []int
+	for img := range imgchan {
+		got = append(got, img.Imgid)
+	}
+	if len(got) != 79 || got[0] != 80 || got[1] != 78 || got[78] != 1 {
+		t.Error("Resumed search got wrong images: ", got)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//commentsPerPage is most comments Derpibooru gives in one page
+const commentsPerPage = 50
+
+//Suffixes of files with comments, next to image
+const (
+	commentsSuffix     = ".comments.json"
+	commentsHTMLSuffix = ".comments.html"
+)
+
+//Comments are fetched by few workers in background, so downloads don't wait for them
+const (
+	commentWorkers = 2
+	commentQueue   = 1024
+)
+
+//threads saves comments of downloaded images. It is nil when nobody asked for comments, all methods are fine with that
+var threads *commentSaver
+
+//comment is single comment under image
+type comment struct {
+	ID      int        `json:"id"`
+	Author  string     `json:"author"`
+	Body    string     `json:"body"`
+	Created time.Time  `json:"created_at"`
+	Edited  *time.Time `json:"edited_at,omitempty"` //Nil for comments nobody edited
+}
+
+//commentThread is everything people said about image, as kept next to it
+type commentThread struct {
+	ID          int       `json:"id"`
+	File        string    `json:"file"` //Image that thread is about
+	Description string    `json:"description,omitempty"`
+	Comments    []comment `json:"comments"`
+	Fetched     time.Time `json:"fetched_at"`
+}
+
+type commentSaver struct {
+	mu    sync.Mutex
+	ctx   context.Context
+	base  url.URL //Server, as it was when workers started
+	dir   string
+	key   string
+	html  bool
+	done  map[int]bool //Image could bring several files, but it has only one thread
+	queue chan Image
+	wg    sync.WaitGroup
+}
+
+//newCommentSaver starts workers. Cancelling context makes them drop what's left in queue
+func newCommentSaver(ctx context.Context, dir, key string, html bool) *commentSaver {
+	s := &commentSaver{ctx: ctx, base: derpiURL, dir: dir, key: key, html: html, done: make(map[int]bool), queue: make(chan Image, commentQueue)}
+	for i := 0; i < commentWorkers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for img := range s.queue {
+				if s.ctx.Err() == nil {
+					s.fetch(img)
+				}
+			}
+		}()
+	}
+	return s
+}
+
+//fetchComments pages through all comments of image on server at base, oldest first
+func fetchComments(ctx context.Context, base url.URL, id int, key string) ([]comment, error) {
+	var all []comment
+	for page := 1; ; page++ {
+		q := url.Values{
+			"q":        {"image_id:" + strconv.Itoa(id)},
+			"page":     {strconv.Itoa(page)},
+			"per_page": {strconv.Itoa(commentsPerPage)},
+		}
+		body, err := getJSON(ctx, apiURL(base, "/api/v1/json/search/comments", q, key))
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Comments []comment `json:"comments"`
+			Total    int       `json:"total"`
+		}
+		if err = json.Unmarshal(body, &res); err != nil {
+			return nil, err
+		}
+		all = append(all, res.Comments...)
+		if len(res.Comments) == 0 || len(all) >= res.Total {
+			break
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Created.Before(all[j].Created) })
+	return all, nil
+}
+
+//saved queues comments of image that is now in target directory to be put next to it. Images that were there before
+//get them only if they have none yet, or every run would ask for comments of whole collection
+func (s *commentSaver) saved(img Image, fresh bool) {
+	if s == nil {
+		return
+	}
+	if !fresh {
+		if _, err := os.Stat(constructFilepath(strconv.Itoa(img.Imgid), s.dir) + commentsSuffix); err == nil {
+			return
+		}
+	}
+	s.mu.Lock()
+	if s.done[img.Imgid] {
+		s.mu.Unlock()
+		return
+	}
+	s.done[img.Imgid] = true
+	s.mu.Unlock()
+	s.queue <- img
+}
+
+//close waits for comments in queue to be saved
+func (s *commentSaver) close() {
+	if s == nil {
+		return
+	}
+	close(s.queue)
+	s.wg.Wait()
+}
+
+//fetch gets comments of image and puts them next to it
+func (s *commentSaver) fetch(img Image) {
+	comments, err := fetchComments(s.ctx, s.base, img.Imgid, s.key)
+	if err != nil {
+		lErr("Could not get comments of image", img.Imgid, err)
+		report.apiError(err)
+		return
+	}
+	th := commentThread{ID: img.Imgid, File: img.Filename, Description: img.Description, Comments: comments, Fetched: time.Now()}
+	if err = th.write(s.dir, s.html); err != nil {
+		lErr("Could not save comments of image", img.Imgid, err)
+		return
+	}
+	lDetailw("Saved "+strconv.Itoa(len(comments))+" comments", logFields{"image_id": img.Imgid})
+}
+
+//write puts thread next to image, and its page too if asked
+func (th *commentThread) write(dir string, html bool) error {
+	raw, err := json.MarshalIndent(th, "", "  ")
+	if err != nil {
+		return err
+	}
+	base := constructFilepath(strconv.Itoa(th.ID), dir)
+	if err = ioutil.WriteFile(base+commentsSuffix, raw, 0600); err != nil {
+		return err
+	}
+	if !html {
+		return nil
+	}
+
+	f, err := os.Create(base + commentsHTMLSuffix)
+	if err != nil {
+		return err
+	}
+	if err = threadPage.Execute(f, th); err != nil {
+		_ = f.Close() //Template error is more interesting
+		return err
+	}
+	return f.Close()
+}
+
+//readThread gets comments kept next to image, if there are any
+func readThread(dir string, id int) (*commentThread, error) {
+	raw, err := ioutil.ReadFile(constructFilepath(strconv.Itoa(id), dir) + commentsSuffix)
+	if err != nil {
+		return nil, err
+	}
+	th := new(commentThread)
+	return th, json.Unmarshal(raw, th)
+}
+
+//pageFuncs are helpers for templates of pages we make
+var pageFuncs = template.FuncMap{
+	"when":  func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"lines": func(s string) []string { return strings.Split(s, "\n") },
+}
+
+//threadPage is simple page with image, its description and comments. Bodies are shown as they were written, markup and all
+var threadPage = template.Must(template.New("thread").Funcs(pageFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Image {{.ID}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: auto; padding: 1em; }
+img { max-width: 100%; }
+.comment { border-top: 1px solid #ccc; padding: 0.5em 0; }
+.meta { color: #777; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<p><a href="{{.File}}"><img src="{{.File}}" alt="Image {{.ID}}"></a></p>
+{{if .Description}}<h2>Description</h2>
+<p>{{range lines .Description}}{{.}}<br>{{end}}</p>
+{{end}}<h2>Comments</h2>
+{{range .Comments}}<div class="comment">
+<div class="meta"><b>{{.Author}}</b>, {{when .Created}}{{if .Edited}}, edited {{when .Edited}}{{end}}</div>
+<p>{{range lines .Body}}{{.}}<br>{{end}}</p>
+</div>
+{{else}}<p>No comments</p>
+{{end}}<p class="meta">Fetched {{when .Fetched}}</p>
+</body>
+</html>
+`))
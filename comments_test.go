@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveComments(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var pages []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pages = append(pages, q.Get("page"))
+		if r.URL.Path != "/api/v1/json/search/comments" || q.Get("q") != "image_id:7" {
+			http.NotFound(w, r)
+			return
+		}
+		var page int
+		fmt.Sscan(q.Get("page"), &page)
+		var res []comment
+		for i := 0; i < commentsPerPage && (page-1)*commentsPerPage+i < 60; i++ {
+			n := (page-1)*commentsPerPage + i
+			res = append(res, comment{ID: n, Author: "Anonymous", Body: "<b>yay</b>\nline " + fmt.Sprint(n), Created: start.Add(-time.Duration(n) * time.Hour)})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"comments": res, "total": 60})
+	}))
+	defer ts.Close()
+	saved := derpiURL
+	defer func() { derpiURL = saved }()
+	u, _ := url.Parse(ts.URL)
+	derpiURL.Scheme, derpiURL.Host = u.Scheme, u.Host
+
+	dir := t.TempDir()
+	s := newCommentSaver(context.Background(), dir, "", true)
+	img := Image{Imgid: 7, Filename: "7.png", Description: "Best pony"}
+	s.saved(img, true)
+	s.saved(Image{Imgid: 7, Filename: "7.gif"}, true)
+	s.close()
+	if strings.Join(pages, ",") != "1,2" {
+		t.Error("Wrong pages asked for: ", pages)
+	}
+
+	//Next run finds images in place: only one without comments gets them
+	s = newCommentSaver(context.Background(), dir, "", false)
+	s.saved(img, false)
+	s.saved(Image{Imgid: 8, Filename: "8.png"}, false)
+	s.close()
+	if strings.Join(pages, ",") != "1,2,1" {
+		t.Error("Comments asked for again: ", pages)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "7"+commentsSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var th commentThread
+	if err = json.Unmarshal(raw, &th); err != nil {
+		t.Fatal(err)
+	}
+	if th.ID != 7 || th.File != "7.png" || th.Description != "Best pony" || len(th.Comments) != 60 || th.Comments[0].ID != 59 {
+		t.Errorf("Wrong thread: %d comments, first is %+v", len(th.Comments), th.Comments[0])
+	}
+
+	page, _ := ioutil.ReadFile(filepath.Join(dir, "7"+commentsHTMLSuffix))
+	if !strings.Contains(string(page), `<img src="7.png"`) || !strings.Contains(string(page), "&lt;b&gt;yay&lt;/b&gt;<br>line 0<br>") {
+		t.Errorf("Wrong page:\n%s", page)
+	}
+}
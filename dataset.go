@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//Names of dataset parts
+const (
+	splitTrain = "train"
+	splitVal   = "val"
+)
+
+//generalCategory is what tags Derpibooru doesn't sort anywhere are called in tag order
+const generalCategory = "general"
+
+//DatasetOpts decide how pictures become dataset
+type DatasetOpts struct {
+	TagOrder    string  `long:"tag-order" description:"Order of tags in captions by category or namespace, like character,species,artist,general. Tags of other categories follow, in order Derpibooru gives them"`
+	DropTags    string  `long:"drop-tags" description:"Tags to leave out of captions, comma separated, * matches anything, like artist:*,safe"`
+	RewriteTags NameMap `long:"rewrite-tags" description:"Tags to replace in captions, like \"princess luna=luna,solo=\". Empty replacement drops tag"`
+	ValSplit    float64 `long:"val-split" description:"Share of images put into validation set, like 0.1. Zero puts everything right into dataset directory"`
+	SplitSeed   string  `long:"split-seed" description:"Changes which images go into validation set. The same seed always gives the same split"`
+	Args        struct {
+		Dir string `positional-arg-name:"dir" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+//datasetEntry is single picture of dataset, as noted in its manifest
+type datasetEntry struct {
+	ID      int    `json:"id"`
+	File    string `json:"file"`    //Relative to dataset directory, with forward slashes
+	Caption string `json:"caption"` //The same
+	Split   string `json:"split"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	SHA256  string `json:"sha256"`
+}
+
+//dropped tells if tag is left out of captions
+func (d *DatasetOpts) dropped(tag string) bool {
+	for _, pattern := range splitTags(d.DropTags) {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//caption turns tags of image into caption: drops, rewrites and sorts them by category
+func (d *DatasetOpts) caption(c *imageCatalogue, tags []string) string {
+	order := splitTags(d.TagOrder)
+	groups := make([][]string, len(order)+1) //Last one is for everything not in order
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		if d.dropped(t) {
+			continue
+		}
+		cat, _ := c.category(t)
+		if cat == "" {
+			cat = generalCategory
+		}
+		if to, ok := d.RewriteTags[t]; ok {
+			t = to
+		}
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+
+		g := len(order)
+		for i, o := range order {
+			if o == cat {
+				g = i
+				break
+			}
+		}
+		groups[g] = append(groups[g], t)
+	}
+
+	var res []string
+	for _, g := range groups {
+		res = append(res, g...)
+	}
+	return strings.Join(res, ", ")
+}
+
+//split decides where image goes by hash of its ID, so the same image always lands in the same part
+func (d *DatasetOpts) split(id int) string {
+	sum := sha256.Sum256([]byte(d.SplitSeed + ":" + strconv.Itoa(id)))
+	if float64(binary.BigEndian.Uint64(sum[:8])>>11)/(1<<53) < d.ValSplit {
+		return splitVal
+	}
+	return splitTrain
+}
+
+//pictureSize is how big picture really is. Catalogue knows only size of original, and we could have some render of it
+func pictureSize(path string) (width, height int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close() //Read-only, nothing to lose
+	cfg, _, err := image.DecodeConfig(f)
+	return cfg.Width, cfg.Height, err
+}
+
+//sha256File is hash of file exactly as it is
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() //Read-only, nothing to lose
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//exportDataset puts every picture in catalogue that is big enough into dataset directory, with caption next to it,
+//and writes manifest of it all. Videos and vector images are not for training, they are left out
+func exportDataset(c *imageCatalogue, dir string, d *DatasetOpts, minWidth, minHeight int) (entries []datasetEntry, skipped int, err error) {
+	for _, e := range c.list() {
+		caption := d.caption(c, e.Tags)
+		split := d.split(e.ID)
+		for _, file := range e.Files {
+			if !canDHash(file) {
+				continue
+			}
+			src := constructFilepath(file, c.dir)
+			w, h, serr := pictureSize(src)
+			if serr != nil {
+				lWarn("Skipping", file, serr)
+				skipped++
+				continue
+			}
+			if w < minWidth || h < minHeight {
+				lDetail("Skipping", file, "it is too small:", w, "x", h)
+				skipped++
+				continue
+			}
+
+			rel := file
+			if d.ValSplit > 0 {
+				rel = split + "/" + file
+			}
+			ent := datasetEntry{ID: e.ID, File: rel, Caption: strings.TrimSuffix(rel, path.Ext(rel)) + ".txt", Split: split, Width: w, Height: h}
+			dst := filepath.Join(dir, filepath.FromSlash(rel))
+			if err = placeFile(src, dst); err != nil {
+				return
+			}
+			if err = writeSidecar(filepath.Join(dir, filepath.FromSlash(ent.Caption)), caption+"\n"); err != nil {
+				return
+			}
+			if ent.SHA256, err = sha256File(dst); err != nil {
+				return
+			}
+			entries = append(entries, ent)
+		}
+	}
+	err = writeDatasetManifest(filepath.Join(dir, manifestName), entries)
+	return
+}
+
+//writeDatasetManifest notes every picture of dataset, one JSON per line
+func writeDatasetManifest(path string, entries []datasetEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			_ = f.Close() //Encoding error is more interesting
+			return err
+		}
+	}
+	return f.Close()
+}
+
+//datasetCmd is export-dataset command: turn target directory into dataset for training
+func datasetCmd(opts *Options) int {
+	d := &opts.DatasetCmd
+	if d.ValSplit < 0 || d.ValSplit > 1 {
+		lFatal("Share of validation set must be from 0 to 1")
+	}
+	c, err := readCatalogue(opts.ImageDir)
+	if err != nil {
+		lFatal("Could not read catalogue of target directory: ", err)
+	}
+	if len(c.entries) == 0 {
+		lDone("Nothing in catalogue of target directory, nothing to export")
+		return exitOK
+	}
+
+	entries, skipped, err := exportDataset(c, d.Args.Dir, d, opts.MinWidth, opts.MinHeight)
+	if err != nil {
+		lErr("Could not finish export: ", err)
+		return exitPartial
+	}
+	val := 0
+	for _, e := range entries {
+		if e.Split == splitVal {
+			val++
+		}
+	}
+	lDone("Exported", len(entries), "pictures into", d.Args.Dir, "of them", val, "for validation, skipped", skipped)
+	return exitOK
+}
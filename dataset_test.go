@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaption(t *testing.T) {
+	c := &imageCatalogue{categories: map[string]string{"princess luna": "character", "alicorn": "species", "safe": "rating", "solo": ""}}
+	d := &DatasetOpts{TagOrder: "character,artist,general", DropTags: "safe,editor:*", RewriteTags: NameMap{"princess luna": "luna", "alicorn": ""}}
+	tags := []string{"safe", "alicorn", "solo", "artist:somepony", "editor:someone", "princess luna", "luna"}
+	if got := d.caption(c, tags); got != "luna, artist:somepony, solo" {
+		t.Errorf("Wrong caption: %q", got)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	d := &DatasetOpts{ValSplit: 0.2}
+	val := 0
+	for id := 0; id < 1000; id++ {
+		if d.split(id) == splitVal {
+			val++
+		}
+		if d.split(id) != d.split(id) {
+			t.Fatal("Split is not deterministic")
+		}
+	}
+	if val < 150 || val > 250 {
+		t.Error("Validation set is off: ", val, " of 1000")
+	}
+	if (&DatasetOpts{}).split(1) != splitTrain {
+		t.Error("Validation set without asking for it")
+	}
+}
+
+func TestExportDataset(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	c, err := openCatalogue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.noted(Image{Imgid: 1, Filename: "1.png", Tags: "alicorn, solo"})
+	c.noted(Image{Imgid: 1, Filename: "1.svg", Tags: "alicorn, solo"})
+	c.noted(Image{Imgid: 2, Filename: "2.png", Tags: "solo"})
+	_ = c.close()
+	for name, size := range map[string]int{"1.png": 64, "2.png": 16} {
+		f, _ := os.Create(filepath.Join(dir, name))
+		if err = png.Encode(f, testPicture(size, size, false)); err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+	}
+	_ = ioutil.WriteFile(filepath.Join(dir, "1.svg"), []byte("<svg/>"), 0600)
+
+	entries, skipped, err := exportDataset(c, out, &DatasetOpts{ValSplit: 0.5}, 32, 32)
+	if err != nil || len(entries) != 1 || skipped != 1 {
+		t.Fatal("Exported ", entries, ", skipped ", skipped, ": ", err)
+	}
+	e := entries[0]
+	if e.Width != 64 || !strings.HasPrefix(e.File, e.Split+"/") || e.Caption != e.Split+"/1.txt" || len(e.SHA256) != 64 {
+		t.Errorf("Wrong entry: %+v", e)
+	}
+	if caption, _ := ioutil.ReadFile(filepath.Join(out, e.Split, "1.txt")); string(caption) != "alicorn, solo\n" {
+		t.Errorf("Wrong caption: %q", caption)
+	}
+
+	f, err := os.Open(filepath.Join(out, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	var got datasetEntry
+	if !sc.Scan() || json.Unmarshal(sc.Bytes(), &got) != nil || got != e || sc.Scan() {
+		t.Errorf("Wrong manifest, got %+v", got)
+	}
+}
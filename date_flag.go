@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Date is a point in time, that could be passed either as absolute date, like "2017-12-20",
+//or relative to the moment of launch, like "7d" for a week ago
+type Date struct {
+	time.Time
+	next time.Time //Start of day, month or year after one given without time, zero otherwise
+}
+
+//dateLayouts are tried in order when date is absolute, with how long the date lasts when time isn't given
+var dateLayouts = []struct {
+	layout              string
+	years, months, days int
+}{
+	{time.RFC3339, 0, 0, 0},
+	{"2006-01-02T15:04:05", 0, 0, 0},
+	{"2006-01-02 15:04:05", 0, 0, 0},
+	{"2006-01-02 15:04", 0, 0, 0},
+	{"2006-01-02", 0, 0, 1},
+	{"2006-01", 0, 1, 0},
+	{"2006", 1, 0, 0},
+}
+
+//now is replaceable for the sake of testing relative dates
+var now = time.Now
+
+//UnmarshalFlag implements flags.Unmarshaler interface for Date
+func (d *Date) UnmarshalFlag(value string) error {
+	v := strings.TrimSpace(value)
+	if t, ok := relativeDate(v); ok {
+		d.Time, d.next = t, time.Time{}
+		return nil
+	}
+	for _, l := range dateLayouts {
+		if t, err := time.ParseInLocation(l.layout, v, time.Local); err == nil {
+			d.Time, d.next = t, time.Time{}
+			if l.years+l.months+l.days != 0 {
+				d.next = t.AddDate(l.years, l.months, l.days)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("`%s' is not a date, try \"2017-12-20\" or \"7d\"", value)
+}
+
+//MarshalFlag implements flags.Marshaler interface for Date
+func (d Date) MarshalFlag() (string, error) {
+	if d.IsZero() {
+		return "", nil
+	}
+	return d.Format(time.RFC3339), nil
+}
+
+//before is the first moment date doesn't cover: "--until 2017-12-20" means the whole of that day is fine,
+//and "--until 2017-12-20 10:00:00" the whole of that second, as server keeps fractions of it
+func (d Date) before() time.Time {
+	if d.next.IsZero() {
+		return d.Truncate(time.Second).Add(time.Second)
+	}
+	return d.next
+}
+
+//relativeDate understands hours, days, weeks, months and years ago, like "12h", "7d", "2w", "3m", "1y"
+func relativeDate(v string) (time.Time, bool) {
+	if len(v) < 2 {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(v[:len(v)-1])
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	t := now()
+	switch v[len(v)-1] {
+	case 'h':
+		return t.Add(-time.Duration(n) * time.Hour), true
+	case 'd':
+		return t.AddDate(0, 0, -n), true
+	case 'w':
+		return t.AddDate(0, 0, -7*n), true
+	case 'm':
+		return t.AddDate(0, -n, 0), true
+	case 'y':
+		return t.AddDate(-n, 0, 0), true
+	}
+	return time.Time{}, false
+}
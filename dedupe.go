@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Ways to link duplicate to original
+const (
+	linkHard    = "hardlink"
+	linkReflink = "reflink" //Copy-on-write clone, files share blocks until one of them is changed
+	linkSymlink = "symlink"
+)
+
+//errReflinkUnsupported is when system or filesystem can't clone files
+var errReflinkUnsupported = errors.New("reflinks are not supported here")
+
+//linkFile replaces dst with link to src. Dst stays as it was if linking fails
+func linkFile(mode, src, dst string) error {
+	tmp := dst + ".link"
+	var err error
+	switch mode {
+	case linkHard:
+		err = os.Link(src, tmp)
+	case linkSymlink:
+		var rel string
+		if rel, err = filepath.Rel(filepath.Dir(dst), src); err == nil {
+			err = os.Symlink(rel, tmp)
+		}
+	case linkReflink:
+		err = reflink(src, tmp)
+	default:
+		return errors.New("unknown way to link files: " + mode)
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp) //Nothing else to do with it
+		return err
+	}
+	return nil
+}
+
+//hashFile is SHA-256 of file content, the same as index keeps: metadata we embedded into pictures doesn't count
+func hashFile(path string) (string, error) {
+	if canDHash(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(stripMeta(data))
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close() //Read-only, nothing to lose
+	h := sha256.New()
+	if _, err = io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//sameContent tells if two files have exactly the same bytes. Only such files could be linked together
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close() //Read-only, nothing to lose
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == errA, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+//ownFile tells files ponydownloader keeps for itself in target directory from images
+func ownFile(name string) bool {
+	switch name {
+	case indexName, journalName, checkpointName, catalogueName, categoriesName, "config.ini":
+		return true
+	}
+	for _, suffix := range []string{".tmp", ".link", commentsSuffix, commentsHTMLSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+//walkArchive calls fn for every image file in target directory, in order of their names.
+//Hidden directories, links and ponydownloader's own files are skipped
+func walkArchive(dir string, fn func(path, rel string, fi os.FileInfo) error) error {
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != dir && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || ownFile(fi.Name()) || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		return fn(path, archivePath(dir, path), fi)
+	})
+}
+
+//fileID guesses image ID from file name, as ponydownloader names them
+func fileID(name string) int {
+	end := strings.IndexFunc(name, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(name)
+	}
+	id, _ := strconv.Atoi(name[:end])
+	return id
+}
+
+//dedupeArchive goes through target directory, notes every file in index with its hashes and replaces files with the same content
+//with links to the first of them. Returns how many files were linked and how many bytes it saved
+func dedupeArchive(a *archiveIndex, dryRun bool) (linked int, saved int64, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seen := make(map[string]bool)
+	err = walkArchive(a.dir, func(path, rel string, fi os.FileInfo) error {
+		seen[rel] = true
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		e := indexEntry{ID: fileID(fi.Name()), File: rel, Size: fi.Size(), SHA256: hash}
+		if old := a.files[rel]; old.SHA256 == hash {
+			e.DHash, e.Orig = old.DHash, old.Orig
+		}
+		if e.DHash == "" {
+			e.DHash = lookAt(path)
+		}
+		orig, ok := a.original(hash, rel)
+		if !ok {
+			a.put(e)
+			return nil
+		}
+
+		origPath := filepath.Join(a.dir, filepath.FromSlash(orig))
+		if ofi, serr := os.Stat(origPath); serr == nil && os.SameFile(fi, ofi) {
+			a.put(e)
+			return nil //Linked already
+		}
+		if same, serr := sameContent(origPath, path); serr != nil || !same {
+			a.put(e)
+			return nil //Same picture, but with metadata of its own image embedded
+		}
+		lInfo("Same as", orig+":", rel)
+		if !dryRun {
+			if err = linkFile(a.link, origPath, path); err != nil {
+				return err
+			}
+		}
+		linked++
+		saved += fi.Size()
+		a.put(e)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	var gone []string
+	for rel := range a.files {
+		if !seen[rel] {
+			gone = append(gone, rel)
+		}
+	}
+	sort.Strings(gone)
+	for _, rel := range gone { //Deleted since they were downloaded, or symlinked by us
+		if _, serr := os.Lstat(filepath.Join(a.dir, filepath.FromSlash(rel))); os.IsNotExist(serr) {
+			if a.byHash[a.files[rel].SHA256] == rel {
+				delete(a.byHash, a.files[rel].SHA256)
+			}
+			delete(a.files, rel)
+			a.dirty = true
+		}
+	}
+
+	if !dryRun {
+		err = a.save()
+	}
+	return
+}
+
+//dedupe is dedupe command: collapse duplicates in target directory
+func dedupe(opts *Options) int {
+	link := opts.Dedupe
+	if link == "" {
+		link = linkHard
+	}
+	a, err := openArchive(opts.ImageDir, link)
+	if err != nil {
+		lFatal("Could not read index of target directory: ", err)
+	}
+	linked, saved, err := dedupeArchive(a, opts.DryRun)
+	if err != nil {
+		lErr("Could not finish deduplication: ", err)
+		return exitPartial
+	}
+	if opts.DryRun {
+		lDone("Would link", linked, "files, saving", fmtbytes(float64(saved)))
+	} else {
+		lDone("Linked", linked, "files, saved", fmtbytes(float64(saved)))
+	}
+	return exitOK
+}
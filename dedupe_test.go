@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveImageLinksDuplicate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("the same pony everywhere"))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	archive = newArchive(dir, linkHard)
+	defer func() { archive = nil }()
+
+	for _, name := range []string{"1.png", "2.png"} {
+		u, _ := url.Parse(ts.URL + "/" + name)
+		img := Image{Imgid: fileID(name), URL: u, Filename: name}
+		if _, err := img.saveImage(context.Background(), newDirStorage(dir), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, _ := os.Stat(filepath.Join(dir, "1.png"))
+	b, _ := os.Stat(filepath.Join(dir, "2.png"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Error("Duplicate was not linked")
+	}
+	if err := archive.close(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openArchive(dir, "")
+	if err != nil || len(idx.files) != 2 || idx.files["2.png"].ID != 2 || idx.byHash[idx.files["2.png"].SHA256] != "1.png" {
+		t.Errorf("Index is wrong: %+v, %v", idx, err)
+	}
+}
+
+func TestRedownloadKeepsLinkedOriginal(t *testing.T) {
+	content := "the same pony everywhere"
+	broken := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if broken { //Promises more than it gives
+			w.Header().Set("Content-Length", "100")
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	archive = newArchive(dir, linkHard)
+	defer func() { archive = nil }()
+	save := func(name string) error {
+		u, _ := url.Parse(ts.URL + "/" + name)
+		_, err := Image{Imgid: fileID(name), URL: u, Filename: name}.saveImage(context.Background(), newDirStorage(dir), nil)
+		return err
+	}
+	for _, name := range []string{"1.png", "2.png"} {
+		if err := save(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, broken = "changed pony", true
+	if err := save("2.png"); err == nil {
+		t.Fatal("Broken download succeeded")
+	}
+	broken = false
+	if err := save("2.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	one, _ := ioutil.ReadFile(filepath.Join(dir, "1.png"))
+	two, _ := ioutil.ReadFile(filepath.Join(dir, "2.png"))
+	if string(one) != "the same pony everywhere" || string(two) != "changed pony" {
+		t.Errorf("Download went through link: %q, %q", one, two)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(left) != 0 {
+		t.Error("Temporary files left: ", left)
+	}
+}
+
+func TestEmbeddedDuplicateNotLinked(t *testing.T) {
+	var pic bytes.Buffer
+	_ = png.Encode(&pic, testPicture(32, 32, false))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(pic.Bytes())
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	archive = newArchive(dir, linkHard)
+	savedMedia := mediaOpts
+	mediaOpts = &MediaOpts{EmbedMeta: true}
+	defer func() { archive, mediaOpts = nil, savedMedia }()
+
+	save := func(name string) error {
+		u, _ := url.Parse(ts.URL + "/" + name)
+		_, err := Image{Imgid: fileID(name), URL: u, Filename: name, Tags: "pony " + name}.saveImage(context.Background(), newDirStorage(dir), nil)
+		return err
+	}
+	for _, name := range []string{"1.png", "2.png"} {
+		if err := save(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := os.Stat(filepath.Join(dir, "1.png"))
+	b, _ := os.Stat(filepath.Join(dir, "2.png"))
+	if a == nil || b == nil || os.SameFile(a, b) {
+		t.Error("Files with different metadata linked")
+	}
+	if two, _ := ioutil.ReadFile(filepath.Join(dir, "2.png")); !bytes.Contains(two, []byte("pony 2.png")) || bytes.Contains(two, []byte("pony 1.png")) {
+		t.Error("Duplicate carries wrong metadata")
+	}
+	if err := save("2.png"); err != errNoClobber {
+		t.Error("Embedded file downloaded again: ", err)
+	}
+}
+
+func TestDedupeArchive(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"1.png": "pony", "2.png": "pony", "sub/3.png": "pony", "4.png": "other pony", ".thumbs/1.jpg": "pony"}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	linked, saved, err := dedupeArchive(newArchive(dir, linkSymlink), true)
+	if err != nil || linked != 2 || saved != 8 {
+		t.Fatal("Dry run found ", linked, " duplicates of ", saved, " bytes: ", err)
+	}
+	if fi, _ := os.Lstat(filepath.Join(dir, "2.png")); fi.Mode()&os.ModeSymlink != 0 {
+		t.Error("Dry run changed files")
+	}
+
+	a := newArchive(dir, linkSymlink)
+	if linked, _, err = dedupeArchive(a, false); err != nil || linked != 2 {
+		t.Fatal("Linked ", linked, " files: ", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "sub", "3.png")); err != nil || target != filepath.Join("..", "1.png") {
+		t.Error("Wrong link: ", target, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "2.png")); err != nil || string(content) != "pony" {
+		t.Error("Link leads nowhere: ", err)
+	}
+
+	if linked, _, err = dedupeArchive(a, false); err != nil || linked != 0 {
+		t.Error("Links were linked again: ", linked, err)
+	}
+	if len(a.files) != 4 {
+		t.Errorf("Index is wrong: %v", a.files)
+	}
+}
+
+func TestReflinkKeepsMode(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "1.png"), filepath.Join(dir, "2.png")
+	_ = ioutil.WriteFile(src, []byte("picture"), 0600)
+	_ = os.Chmod(src, 0644)
+	_ = ioutil.WriteFile(dst, []byte("picture"), 0600)
+	err := linkFile(linkReflink, src, dst)
+	if err == errReflinkUnsupported {
+		t.Skip("Filesystem can't clone files")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dst); err != nil || fi.Mode().Perm() != 0644 {
+		t.Error("Clone doesn't have mode of original: ", fi, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//NameMap maps names to other names, like Derpibooru namespaces to Hydrus ones or tags to better tags,
+//passed as "artist=creator,species=species". What empty name means depends on what is mapped
+type NameMap map[string]string
+
+//UnmarshalFlag implements flags.Unmarshaler interface for NameMap
+func (m *NameMap) UnmarshalFlag(value string) error {
+	if *m == nil {
+		*m = make(NameMap)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return fmt.Errorf("`%s' is not a mapping, try something like \"artist=creator\"", pair)
+		}
+		(*m)[strings.ToLower(strings.TrimSpace(pair[:i]))] = strings.ToLower(strings.TrimSpace(pair[i+1:]))
+	}
+	return nil
+}
+
+//MarshalFlag implements flags.Marshaler interface for NameMap
+func (m NameMap) MarshalFlag() (string, error) {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ","), nil
+}
+
+//hydrusTag gives tag its Hydrus namespace. Namespace of tag itself goes first, then its category.
+//Tags with namespaces that aren't mapped are left as they are, Hydrus takes them as namespaced anyway
+func (m NameMap) hydrusTag(tag, category string) string {
+	name := tag
+	if i := strings.Index(tag, ":"); i > 0 {
+		ns, ok := m[tag[:i]]
+		if !ok {
+			return tag
+		}
+		category, name = ns, tag[i+1:]
+	} else if ns, ok := m[category]; ok && category != "" {
+		category = ns
+	} else {
+		return tag
+	}
+	if category == "" {
+		return name
+	}
+	return category + ":" + name
+}
+
+//placeFile puts file from target directory into export, as hardlink when it can, as copy when it can't
+func placeFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := linkFile(linkHard, src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //Read-only, nothing to lose
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close() //Copy error is more interesting
+		return err
+	}
+	return out.Close()
+}
+
+//exportHydrus writes every image in catalogue into Hydrus import folder, with .txt sidecar of tags next to it.
+//Everything is taken from target directory, nothing is downloaded. Returns how many files were exported and skipped
+func exportHydrus(c *imageCatalogue, dir string, namespaces NameMap) (exported, skipped int, err error) {
+	for _, e := range c.list() {
+		tags := make([]string, 0, len(e.Tags))
+		for _, t := range e.Tags {
+			cat, _ := c.category(t)
+			tags = append(tags, namespaces.hydrusTag(t, cat))
+		}
+		sidecar := strings.Join(tags, "\n") + "\n"
+
+		for _, file := range e.Files {
+			src := constructFilepath(file, c.dir)
+			if _, serr := os.Stat(src); serr != nil {
+				lWarn("Skipping", file, "it is not in target directory anymore")
+				skipped++
+				continue
+			}
+			dst := filepath.Join(dir, filepath.FromSlash(file))
+			if err = placeFile(src, dst); err != nil {
+				return
+			}
+			if err = writeSidecar(dst+".txt", sidecar); err != nil {
+				return
+			}
+			exported++
+		}
+	}
+	return
+}
+
+//writeSidecar writes text file next to exported image
+func writeSidecar(path, content string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(content); err != nil {
+		_ = f.Close() //Write error is more interesting
+		return err
+	}
+	return f.Close()
+}
+
+//hydrusCmd is export-hydrus command: export target directory into Hydrus import folder
+func hydrusCmd(opts *Options) int {
+	c, err := readCatalogue(opts.ImageDir)
+	if err != nil {
+		lFatal("Could not read catalogue of target directory: ", err)
+	}
+	if len(c.entries) == 0 {
+		lDone("Nothing in catalogue of target directory, nothing to export")
+		return exitOK
+	}
+	if n := len(c.uncategorized()); n != 0 {
+		lWarn("Categories of", n, "tags are unknown, they are exported without namespaces. Next download into target directory learns them")
+	}
+
+	exported, skipped, err := exportHydrus(c, opts.HydrusCmd.Args.Dir, opts.HydrusCmd.Namespaces)
+	if err != nil {
+		lErr("Could not finish export: ", err)
+		return exitPartial
+	}
+	lDone("Exported", exported, "files into", opts.HydrusCmd.Args.Dir, "skipped", skipped)
+	if skipped != 0 {
+		return exitPartial
+	}
+	return exitOK
+}
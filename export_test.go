@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHydrusTag(t *testing.T) {
+	var m NameMap
+	if err := m.UnmarshalFlag("artist=creator, species=species,rating="); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ tag, category, expected string }{
+		{"artist:somepony", "origin", "creator:somepony"},
+		{"oc:shiny", "oc", "oc:shiny"},
+		{"alicorn", "species", "species:alicorn"},
+		{"safe", "rating", "safe"},
+		{"princess luna", "character", "princess luna"},
+		{"smiling", "", "smiling"},
+	} {
+		if got := m.hydrusTag(c.tag, c.category); got != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.tag, c.expected, got)
+		}
+	}
+	if err := m.UnmarshalFlag("artist"); err == nil {
+		t.Error("Mapping without namespace was taken")
+	}
+}
+
+func TestExportHydrus(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	c, err := openCatalogue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.noted(Image{Imgid: 1, Filename: "1.png", Tags: "artist:somepony, alicorn, smiling"})
+	c.noted(Image{Imgid: 2, Filename: "2.png", Tags: "safe"})
+	c.categories["alicorn"] = "species"
+	_ = c.close()
+	if err = ioutil.WriteFile(filepath.Join(dir, "1.png"), []byte("pony"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, skipped, err := exportHydrus(c, out, NameMap{"artist": "artist", "species": "species"})
+	if err != nil || exported != 1 || skipped != 1 {
+		t.Fatal("Exported ", exported, ", skipped ", skipped, ": ", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(out, "1.png")); err != nil || string(content) != "pony" {
+		t.Error("Image was not exported: ", err)
+	}
+	if tags, _ := ioutil.ReadFile(filepath.Join(out, "1.png.txt")); string(tags) != "artist:somepony\nspecies:alicorn\nsmiling\n" {
+		t.Errorf("Wrong sidecar: %q", tags)
+	}
+	if _, err := os.Stat(filepath.Join(out, "2.png.txt")); !os.IsNotExist(err) {
+		t.Error("Sidecar without image: ", err)
+	}
+}
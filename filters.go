@@ -1,6 +1,8 @@
 package main
 
-type filtrator func(<-chan Image) <-chan Image
+import "context"
+
+type filtrator func(context.Context, <-chan Image) <-chan Image
 
 var filters []filtrator
 
@@ -13,31 +15,81 @@ func filterInit(opts *FiltOpts, enableLog bool) {
 	if opts.FavesF {
 		filters = append(filters, filterGenerator(func(i Image) bool { return i.Faves >= opts.Faves }, enableLog))
 	}
+	if opts.MinWidth > 0 {
+		filters = append(filters, filterGenerator(func(i Image) bool { return i.Width >= opts.MinWidth }, enableLog))
+	}
+	if opts.MinHeight > 0 {
+		filters = append(filters, filterGenerator(func(i Image) bool { return i.Height >= opts.MinHeight }, enableLog))
+	}
+	if opts.Aspect.Ratio > 0 {
+		filters = append(filters, filterGenerator(func(i Image) bool { return opts.Aspect.matches(i.Width, i.Height) }, enableLog))
+	}
+	if opts.MaxSize > 0 { //Size unknown to API is zero, such images pass. We would know only after download
+		filters = append(filters, filterGenerator(func(i Image) bool { return i.Size <= int64(opts.MaxSize) }, enableLog))
+	}
+	if opts.Orientation != "" {
+		filters = append(filters, filterGenerator(func(i Image) bool { return orientation(i.Width, i.Height) == opts.Orientation }, enableLog))
+	}
+	if len(opts.Types) != 0 {
+		filters = append(filters, filterGenerator(func(i Image) bool { return opts.Types.has(i.Format) }, enableLog))
+	}
+	//Search applies dates on server already, this is for images by ID and for server being sloppy
+	if !opts.Since.IsZero() {
+		filters = append(filters, filterGenerator(func(i Image) bool { return i.Created.IsZero() || !i.Created.Before(opts.Since.Time) }, enableLog))
+	}
+	if !opts.Until.IsZero() {
+		filters = append(filters, filterGenerator(func(i Image) bool { return i.Created.IsZero() || i.Created.Before(opts.Until.before()) }, enableLog))
+	}
+	if opts.SkipSimilar > 0 { //Goes last, it downloads render of every image that got this far
+		filters = append(filters, filterGeneratorCtx(notSimilar(opts.SkipSimilar), enableLog))
+	}
+}
+
+//orientation names shape of image the same way --orientation flag does
+func orientation(width, height int) string {
+	switch {
+	case width > height:
+		return "landscape"
+	case width < height:
+		return "portrait"
+	default:
+		return "square"
+	}
 }
 
 func filterGenerator(filt func(Image) bool, enableLog bool) filtrator {
-	return func(in <-chan Image) <-chan Image {
+	return filterGeneratorCtx(func(_ context.Context, i Image) bool { return filt(i) }, enableLog)
+}
+
+//filterGeneratorCtx is filterGenerator for filters that need to ask someone and should stop when asked to
+func filterGeneratorCtx(filt func(context.Context, Image) bool, enableLog bool) filtrator {
+	return func(ctx context.Context, in <-chan Image) <-chan Image {
 		out := make(chan Image)
 		go func() {
+			defer close(out)
 			for imgdata := range in {
 
-				if filt(imgdata) { //Capturing score inside lambda, to prevent passing it around each invocation
-					out <- imgdata
+				if filt(ctx, imgdata) { //Capturing score inside lambda, to prevent passing it around each invocation
+					if !send(ctx, out, imgdata) {
+						for range in { //Whoever sends to us may not look at context, it must not hang either
+						}
+						return
+					}
 					continue
 				}
 				lCondInfo(enableLog, "Filtering ", imgdata.Filename)
+				report.add(imgdata, outcomeFiltered, 0, nil)
 			}
-			close(out)
 		}()
 		return out
 	}
 }
 
-//FilterChannel cuts off unneeded images
-func FilterChannel(in <-chan Image) (out <-chan Image) {
+//FilterChannel cuts off unneeded images. Filters stop when context is cancelled
+func FilterChannel(ctx context.Context, in <-chan Image) (out <-chan Image) {
 	out = in
 	for _, filter := range filters {
-		out = filter(out)
+		out = filter(ctx, out)
 	}
 	return
 }
@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestFilterInit(t *testing.T) {
 	filterInit(&FiltOpts{ScoreF: true, FavesF: true}, false)
@@ -11,7 +15,7 @@ func TestFilterInit(t *testing.T) {
 
 func TestFilterNone(t *testing.T) {
 	in := make(chan Image, 1)
-	out := FilterChannel(in)
+	out := FilterChannel(context.Background(), in)
 	in <- Image{}
 	_, ok := <-out
 	if !ok {
@@ -22,7 +26,7 @@ func TestFilterNone(t *testing.T) {
 func TestFilterAlwaysTrue(t *testing.T) {
 	in := make(chan Image, 1)
 	filter := filterGenerator(func(Image) bool { return true }, false)
-	out := filter(in)
+	out := filter(context.Background(), in)
 	in <- Image{}
 	_, ok := <-out
 
@@ -39,7 +43,7 @@ func TestFilterAlwaysTrue(t *testing.T) {
 func TestFilterAlwaysFalse(t *testing.T) {
 	in := make(chan Image, 1)
 	filter := filterGenerator(func(Image) bool { return false }, false)
-	out := filter(in)
+	out := filter(context.Background(), in)
 	in <- Image{}
 
 	close(in)
@@ -56,14 +60,14 @@ func TestFilterComplex(t *testing.T) {
 	in := make(chan Image, 3)
 	in <- Image{Score: -1}
 	in <- Image{Faves: -1}
-	in <- Image{Imgid: "1"}
+	in <- Image{Imgid: 1}
 
-	out := FilterChannel(in)
+	out := FilterChannel(context.Background(), in)
 	close(in)
 	pass := <-out
 
-	if (pass != Image{Imgid: "1"}) {
-		t.Error("Incorrect work of the filter, passed ", pass, "instead of ", Image{Imgid: "1"})
+	if (pass != Image{Imgid: 1}) {
+		t.Error("Incorrect work of the filter, passed ", pass, "instead of ", Image{Imgid: 1})
 	}
 
 	pass, ok := <-out
@@ -72,3 +76,162 @@ func TestFilterComplex(t *testing.T) {
 		t.Error("Wat is going on with FilterChannel?")
 	}
 }
+
+func TestFilterDimensions(t *testing.T) {
+	filters = nil
+	filterInit(&FiltOpts{MinWidth: 1920, MinHeight: 1080, Orientation: "landscape"}, false)
+
+	in := make(chan Image, 4)
+	in <- Image{Imgid: 1, Width: 1280, Height: 720}
+	in <- Image{Imgid: 2, Width: 1080, Height: 1920}
+	in <- Image{Imgid: 3, Width: 2000, Height: 2000}
+	in <- Image{Imgid: 4, Width: 3840, Height: 2160}
+	close(in)
+
+	var passed []int
+	for img := range FilterChannel(context.Background(), in) {
+		passed = append(passed, img.Imgid)
+	}
+	if len(passed) != 1 || passed[0] != 4 {
+		t.Error("Dimension filters passed ", passed, " instead of [4]")
+	}
+	filters = nil
+}
+
+func TestFilterAspectAndSize(t *testing.T) {
+	filters = nil
+	filterInit(&FiltOpts{Aspect: Aspect{Ratio: 16.0 / 9.0, Tolerance: 0.02}, MaxSize: ByteSize(20 * MiB)}, false)
+
+	in := make(chan Image, 4)
+	in <- Image{Imgid: 1, Width: 1920, Height: 1080, Size: 1024}
+	in <- Image{Imgid: 2, Width: 1920, Height: 1080, Size: 21 * int64(MiB)}
+	in <- Image{Imgid: 3, Width: 1600, Height: 1200, Size: 1024}
+	in <- Image{Imgid: 4, Width: 1366, Height: 768}
+	close(in)
+
+	var passed []int
+	for img := range FilterChannel(context.Background(), in) {
+		passed = append(passed, img.Imgid)
+	}
+	if len(passed) != 2 || passed[0] != 1 || passed[1] != 4 {
+		t.Error("Aspect and size filters passed ", passed, " instead of [1 4]")
+	}
+	filters = nil
+}
+
+func TestAspectFlag(t *testing.T) {
+	var a Aspect
+	if err := a.UnmarshalFlag("16:9±0.02"); err != nil || a.Tolerance != 0.02 || a.Ratio != 16.0/9.0 {
+		t.Error("Aspect parsed wrong: ", a, err)
+	}
+	if err := a.UnmarshalFlag("1.5"); err != nil || a.Tolerance != defaultAspectTolerance || a.Ratio != 1.5 {
+		t.Error("Aspect parsed wrong: ", a, err)
+	}
+	if err := a.UnmarshalFlag("16:0"); err == nil {
+		t.Error("Zero height aspect accepted")
+	}
+}
+
+func TestSizeFlag(t *testing.T) {
+	var b ByteSize
+	for in, want := range map[string]ByteSize{"20MiB": 20 << 20, "512k": 512 << 10, "1048576": 1 << 20, "1.5 GiB": 3 << 29} {
+		if err := b.UnmarshalFlag(in); err != nil || b != want {
+			t.Error("Size ", in, " parsed as ", b, " instead of ", want, err)
+		}
+	}
+	if err := b.UnmarshalFlag("lots"); err == nil {
+		t.Error("Garbage size accepted")
+	}
+}
+
+func TestDateFlag(t *testing.T) {
+	fixed := time.Date(2017, time.December, 20, 3, 44, 27, 0, time.UTC)
+	now = func() time.Time { return fixed }
+	defer func() { now = time.Now }()
+
+	var d Date
+	if err := d.UnmarshalFlag("7d"); err != nil || !d.Equal(fixed.AddDate(0, 0, -7)) {
+		t.Error("Relative date parsed wrong: ", d, err)
+	}
+	if err := d.UnmarshalFlag("2017-12-20"); err != nil || d.Year() != 2017 || d.Month() != time.December || d.Day() != 20 {
+		t.Error("Absolute date parsed wrong: ", d, err)
+	}
+	if !d.before().Equal(time.Date(2017, time.December, 21, 0, 0, 0, 0, time.Local)) {
+		t.Error("Day doesn't last until its end: ", d.before())
+	}
+	if err := d.UnmarshalFlag("2017-02"); err != nil || d.before().Month() != time.March || d.before().Day() != 1 {
+		t.Error("Month doesn't last until its end: ", d.before(), err)
+	}
+	if err := d.UnmarshalFlag("2017-12-20 10:00"); err != nil || !d.before().Equal(d.Add(time.Second)) {
+		t.Error("Date with time lasts other than its second: ", d.before(), err)
+	}
+	if err := d.UnmarshalFlag("yesterday"); err == nil {
+		t.Error("Garbage date accepted")
+	}
+}
+
+func TestFilterDates(t *testing.T) {
+	filters = nil
+	since := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	filterInit(&FiltOpts{Since: Date{Time: since}, Until: Date{Time: since.AddDate(1, 0, 0)}}, false)
+
+	in := make(chan Image, 4)
+	in <- Image{Imgid: 1, Created: since.AddDate(0, -1, 0)}
+	in <- Image{Imgid: 2, Created: since.AddDate(0, 1, 0)}
+	in <- Image{Imgid: 3, Created: since.AddDate(2, 0, 0)}
+	in <- Image{Imgid: 4}
+	close(in)
+
+	var passed []int
+	for img := range FilterChannel(context.Background(), in) {
+		passed = append(passed, img.Imgid)
+	}
+	if len(passed) != 2 || passed[0] != 2 || passed[1] != 4 {
+		t.Error("Date filters passed ", passed, " instead of [2 4]")
+	}
+	filters = nil
+}
+
+func TestFormatList(t *testing.T) {
+	var l FormatList
+	if err := l.UnmarshalFlag("png, JPG,webm"); err != nil || len(l) != 3 || !l.has("jpeg") {
+		t.Error("Format list parsed wrong: ", l, err)
+	}
+	if err := l.UnmarshalFlag("bmp"); err == nil {
+		t.Error("Unknown format accepted")
+	}
+}
+
+func TestFilterStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan Image, 2)
+	out := filterGenerator(func(Image) bool { return true }, false)(ctx, in)
+
+	in <- Image{}
+	in <- Image{}
+	cancel() //Nobody reads out, filter must not hang on it
+	close(in)
+	for i := 0; i < 2; i++ {
+		<-out //Unblocked either by image or by closing
+	}
+	if _, ok := <-interrupt(ctx, make(chan Image)); ok {
+		t.Error("Interrupted channel remains open")
+	}
+
+	//Stage before filter doesn't look at context, it only sends
+	upstream := make(chan Image)
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			upstream <- Image{}
+		}
+		close(upstream)
+		close(sent)
+	}()
+	filterGenerator(func(Image) bool { return true }, false)(ctx, upstream)
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Error("Stage before cancelled filter hangs")
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//galleryThumbSize is how big thumbnails in gallery are, by longer side
+const galleryThumbSize = 250
+
+//galleryImage is single image, as shown in gallery
+type galleryImage struct {
+	catalogueEntry
+	Main   string //File that is shown
+	Video  bool
+	Thumb  string //From gallery root, empty when there is no thumbnail
+	Derpi  string
+	Links  []*galleryTag
+	Thread *commentThread
+}
+
+//galleryTag is tag with all images that have it
+type galleryTag struct {
+	Name     string
+	Slug     string
+	Category string
+	Images   []*galleryImage
+}
+
+//Count is how many images tag has
+func (t *galleryTag) Count() int {
+	return len(t.Images)
+}
+
+//galleryPage is what every page template gets
+type galleryPage struct {
+	Title  string
+	Root   string //From page to gallery root
+	Dir    string //From page to target directory
+	Search bool
+	Images []*galleryImage
+	Image  *galleryImage
+	Tags   []*galleryTag
+}
+
+//tagSlug turns tag into something that is fine as file name anywhere. Hash at the end keeps tags that look alike apart
+func tagSlug(tag string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(tag) {
+		if 'a' <= r && r <= 'z' || '0' <= r && r <= '9' {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() != 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= 40 {
+			break
+		}
+	}
+	sum := sha1.Sum([]byte(tag))
+	base := strings.TrimSuffix(b.String(), "-")
+	if base == "" {
+		base = "tag"
+	}
+	return base + "-" + hex.EncodeToString(sum[:3])
+}
+
+//isVideo tells if file is to be played rather than looked at
+func isVideo(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".webm" || ext == ".mp4"
+}
+
+//galleryImages gathers every image in target directory, with whatever catalogue knows about it, newest first.
+//Images downloaded before catalogue was kept are there too, with their files only. Files in skip directory are not images
+func galleryImages(c *imageCatalogue, skip string) ([]*galleryImage, error) {
+	onDisk := make(map[int][]string)
+	err := walkArchive(c.dir, func(p, rel string, fi os.FileInfo) error {
+		if abs, _ := filepath.Abs(p); skip != "" && strings.HasPrefix(abs, skip+string(os.PathSeparator)) {
+			return nil
+		}
+		if id := fileID(rel); id != 0 {
+			onDisk[id] = append(onDisk[id], rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*galleryImage
+	for id, files := range onDisk {
+		e, ok := c.entries[id]
+		if !ok {
+			e = catalogueEntry{ID: id, Files: files}
+		}
+		var present []string
+		for _, f := range e.Files {
+			if _, err := os.Stat(constructFilepath(f, c.dir)); err == nil {
+				present = append(present, f)
+			}
+		}
+		if len(present) == 0 {
+			present = files //Catalogue is behind on what's there
+		}
+		e.Files = present
+
+		img := &galleryImage{catalogueEntry: e, Main: present[0], Derpi: derpiURL.Scheme + "://" + derpiURL.Host + "/" + strconv.Itoa(id)}
+		for _, f := range present {
+			if canDHash(f) {
+				img.Main = f
+				break
+			}
+		}
+		img.Video = isVideo(img.Main)
+		if th, err := readThread(c.dir, id); err == nil {
+			img.Thread = th
+			if img.Description == "" {
+				img.Description = th.Description //Comments are fetched anew, so they know description better than catalogue of old
+			}
+		}
+		res = append(res, img)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID > res[j].ID })
+	return res, nil
+}
+
+//galleryTags sorts images by tags, most used tags first
+func galleryTags(c *imageCatalogue, images []*galleryImage) []*galleryTag {
+	byName := make(map[string]*galleryTag)
+	var tags []*galleryTag
+	for _, img := range images {
+		for _, name := range img.catalogueEntry.Tags {
+			t, ok := byName[name]
+			if !ok {
+				cat, _ := c.category(name)
+				t = &galleryTag{Name: name, Slug: tagSlug(name), Category: cat}
+				byName[name] = t
+				tags = append(tags, t)
+			}
+			t.Images = append(t.Images, img)
+			img.Links = append(img.Links, t)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		if len(tags[i].Images) != len(tags[j].Images) {
+			return len(tags[i].Images) > len(tags[j].Images)
+		}
+		return tags[i].Name < tags[j].Name
+	})
+	return tags
+}
+
+//writePage renders page template into file
+func writePage(file, name string, p *galleryPage) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err = galleryTemplates.ExecuteTemplate(f, name, p); err != nil {
+		_ = f.Close() //Template error is more interesting
+		return err
+	}
+	return f.Close()
+}
+
+//buildGallery makes static site out of target directory: pages of all images, of every tag and of every image,
+//with thumbnails and search. It all works from file://, so links to images are relative
+func buildGallery(c *imageCatalogue, dir string) (int, error) {
+	out, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	src, err := filepath.Abs(c.dir)
+	if err != nil {
+		return 0, err
+	}
+	rel, err := filepath.Rel(out, src)
+	if err != nil {
+		return 0, err
+	}
+	files := filepath.ToSlash(rel) + "/"
+
+	for _, sub := range []string{"thumbs", "images", "tags"} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return 0, err
+		}
+	}
+
+	images, err := galleryImages(c, out)
+	if err != nil {
+		return 0, err
+	}
+	tags := galleryTags(c, images)
+
+	search := make(map[int][]string, len(images))
+	for _, img := range images {
+		search[img.ID] = append([]string{}, img.catalogueEntry.Tags...)
+		if !canDHash(img.Main) {
+			continue
+		}
+		picture := constructFilepath(img.Main, c.dir)
+		if thumbFresh(picture, thumbPath(c.dir, img.Main)) { //Made by --thumbs already
+			img.Thumb = files + thumbsDir + "/" + thumbName(img.Main)
+			continue
+		}
+		thumb := filepath.Join(dir, "thumbs", strconv.Itoa(img.ID)+".jpg")
+		if !thumbFresh(picture, thumb) {
+			if err := makeThumb(picture, thumb, galleryThumbSize); err != nil {
+				lWarn("Could not make thumbnail of", img.Main, err)
+				continue
+			}
+		}
+		img.Thumb = "thumbs/" + strconv.Itoa(img.ID) + ".jpg"
+	}
+
+	data, err := json.Marshal(search)
+	if err != nil {
+		return 0, err
+	}
+	statics := map[string]string{
+		"style.css": galleryStyle,
+		"search.js": gallerySearch,
+		"data.js":   "var galleryTags = " + string(data) + ";\n",
+	}
+	for name, content := range statics {
+		if err = writeSidecar(filepath.Join(dir, name), content); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = writePage(filepath.Join(dir, "index.html"), "grid", &galleryPage{Title: "All images", Dir: files, Search: true, Images: images}); err != nil {
+		return 0, err
+	}
+	if err = writePage(filepath.Join(dir, "tags", "index.html"), "tags", &galleryPage{Title: "Tags", Root: "../", Dir: "../" + files, Tags: tags}); err != nil {
+		return 0, err
+	}
+	for _, t := range tags {
+		p := &galleryPage{Title: t.Name, Root: "../", Dir: "../" + files, Images: t.Images}
+		if err = writePage(filepath.Join(dir, "tags", t.Slug+".html"), "grid", p); err != nil {
+			return 0, err
+		}
+	}
+	for _, img := range images {
+		p := &galleryPage{Title: "Image " + strconv.Itoa(img.ID), Root: "../", Dir: "../" + files, Image: img}
+		if err = writePage(filepath.Join(dir, "images", strconv.Itoa(img.ID)+".html"), "image", p); err != nil {
+			return 0, err
+		}
+	}
+	return len(images), nil
+}
+
+//galleryCmd is gallery-html command: make static site out of target directory
+func galleryCmd(opts *Options) int {
+	c, err := readCatalogue(opts.ImageDir)
+	if err != nil {
+		lFatal("Could not read catalogue of target directory: ", err)
+	}
+	n, err := buildGallery(c, opts.GalleryCmd.Args.Dir)
+	if err != nil {
+		lErr("Could not finish gallery: ", err)
+		return exitPartial
+	}
+	lDone("Gallery of", n, "images is in", filepath.Join(opts.GalleryCmd.Args.Dir, "index.html"))
+	return exitOK
+}
+
+var galleryTemplates = template.Must(template.New("gallery").Funcs(pageFuncs).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Root}}style.css">
+</head>
+<body>
+<nav><a href="{{.Root}}index.html">All images</a> <a href="{{.Root}}tags/index.html">Tags</a></nav>
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "grid"}}{{template "head" .}}{{if .Search}}<p><input id="search" type="search" placeholder="Tags, comma separated, - to leave out, like luna, -sad"> <span id="count">{{len .Images}} images</span></p>
+{{end}}<div class="grid">
+{{range .Images}}<a href="{{$.Root}}images/{{.ID}}.html" data-id="{{.ID}}">{{if .Thumb}}<img loading="lazy" src="{{$.Root}}{{.Thumb}}" alt="{{.ID}}">{{else}}<span>{{.ID}}<br>{{.Main}}</span>{{end}}</a>
+{{end}}</div>
+{{if .Search}}<script src="data.js"></script>
+<script src="search.js"></script>
+{{end}}</body>
+</html>
+{{end}}
+
+{{define "image"}}{{template "head" .}}{{with .Image}}<p class="view">{{if .Video}}<video src="{{$.Dir}}{{.Main}}" controls loop></video>{{else}}<a href="{{$.Dir}}{{.Main}}"><img src="{{$.Dir}}{{.Main}}" alt="{{.ID}}"></a>{{end}}</p>
+<table>
+<tr><th>Score</th><td>{{.Score}}</td></tr>
+<tr><th>Faves</th><td>{{.Faves}}</td></tr>
+{{if .Width}}<tr><th>Size</th><td>{{.Width}}×{{.Height}}</td></tr>
+{{end}}{{if not .Created.IsZero}}<tr><th>Uploaded</th><td>{{when .Created}}</td></tr>
+{{end}}{{if .Source}}<tr><th>Source</th><td><a href="{{.Source}}">{{.Source}}</a></td></tr>
+{{end}}<tr><th>Derpibooru</th><td><a href="{{.Derpi}}">{{.Derpi}}</a></td></tr>
+<tr><th>Files</th><td>{{range .Files}}<a href="{{$.Dir}}{{.}}">{{.}}</a> {{end}}</td></tr>
+</table>
+<p class="tags">{{range .Links}}<a href="{{$.Root}}tags/{{.Slug}}.html">{{.Name}}</a> {{end}}</p>
+{{if .Description}}<h2>Description</h2>
+<p>{{range lines .Description}}{{.}}<br>{{end}}</p>
+{{end}}{{with .Thread}}<h2>Comments</h2>
+{{range .Comments}}<div class="comment">
+<div class="meta"><b>{{.Author}}</b>, {{when .Created}}</div>
+<p>{{range lines .Body}}{{.}}<br>{{end}}</p>
+</div>
+{{else}}<p>No comments</p>
+{{end}}{{end}}{{end}}</body>
+</html>
+{{end}}
+
+{{define "tags"}}{{template "head" .}}<ul class="taglist">
+{{range .Tags}}<li><a href="{{.Slug}}.html">{{.Name}}</a> <span class="meta">{{.Count}}{{if .Category}}, {{.Category}}{{end}}</span></li>
+{{end}}</ul>
+</body>
+</html>
+{{end}}
+`))
+
+const galleryStyle = `body { font-family: sans-serif; margin: 1em; background: #f4f4f4; }
+nav a { margin-right: 1em; }
+.grid { display: flex; flex-wrap: wrap; gap: 6px; }
+.grid a { width: 250px; height: 250px; display: flex; align-items: center; justify-content: center; background: #fff; text-decoration: none; color: #777; }
+.grid img { max-width: 250px; max-height: 250px; }
+.view img, .view video { max-width: 100%; max-height: 90vh; }
+th { text-align: left; padding-right: 1em; }
+.tags a { display: inline-block; margin: 2px; padding: 2px 6px; background: #dde; border-radius: 4px; text-decoration: none; }
+.comment { border-top: 1px solid #ccc; padding: 0.5em 0; }
+.meta { color: #777; font-size: 0.9em; }
+#search { width: 30em; }
+`
+
+//gallerySearch hides images that don't match what's typed. Every term must be in some tag, unless it starts with -
+const gallerySearch = `(function () {
+	var input = document.getElementById("search");
+	var count = document.getElementById("count");
+	var items = document.querySelectorAll(".grid a");
+	input.addEventListener("input", function () {
+		var terms = input.value.toLowerCase().split(",").map(function (t) { return t.trim(); }).filter(function (t) { return t !== "" && t !== "-"; });
+		var shown = 0;
+		for (var i = 0; i < items.length; i++) {
+			var tags = galleryTags[items[i].getAttribute("data-id")] || [];
+			var ok = terms.every(function (term) {
+				var not = term.charAt(0) === "-";
+				if (not) {
+					term = term.slice(1).trim();
+				}
+				var has = tags.some(function (tag) { return tag.indexOf(term) >= 0; });
+				return has !== not;
+			});
+			items[i].style.display = ok ? "" : "none";
+			if (ok) {
+				shown++;
+			}
+		}
+		count.textContent = shown + " images";
+	});
+})();
+`
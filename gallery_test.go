@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTagSlug(t *testing.T) {
+	a, b := tagSlug("artist:some pony"), tagSlug("artist-some-pony")
+	if !strings.HasPrefix(a, "artist-some-pony-") || a == b {
+		t.Errorf("Wrong slugs: %s, %s", a, b)
+	}
+	if s := tagSlug(":)"); !strings.HasPrefix(s, "tag-") {
+		t.Error("Wrong slug of tag without letters: ", s)
+	}
+}
+
+func TestBuildGallery(t *testing.T) {
+	root := t.TempDir()
+	dir, out := filepath.Join(root, "img"), filepath.Join(root, "img", "gallery")
+	_ = os.MkdirAll(dir, 0700)
+	c, err := openCatalogue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.noted(Image{Imgid: 1, Filename: "1.png", Tags: "princess luna, safe", Score: 42, Source: "https://example.com/luna"})
+	c.noted(Image{Imgid: 2, Filename: "2.webm", Tags: "safe"})
+	_ = c.close()
+	f, _ := os.Create(filepath.Join(dir, "1.png"))
+	if err = png.Encode(f, testPicture(600, 300, false)); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	_ = ioutil.WriteFile(filepath.Join(dir, "2.webm"), []byte("not really a video"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "3.gif"), []byte("not in catalogue"), 0600)
+	th := commentThread{ID: 1, File: "1.png", Description: "Best pony", Comments: []comment{{Author: "Anonymous", Body: "<3"}}}
+	if err = th.write(dir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tm := newThumbMaker(context.Background(), dir, 100)
+	tm.add("1.png")
+	tm.close()
+	for run := 0; run < 2; run++ { //Second run is over gallery inside target directory, it must not be taken for images
+		if n, err := buildGallery(c, out); err != nil || n != 3 {
+			t.Fatal("Gallery of ", n, " images: ", err)
+		}
+	}
+
+	read := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+		}
+		return string(content)
+	}
+	if _, err := os.Stat(filepath.Join(out, "thumbs", "1.jpg")); !os.IsNotExist(err) {
+		t.Error("Thumbnail was made when there is one already: ", err)
+	}
+	index := read("index.html")
+	if !strings.Contains(index, `href="images/1.html"`) || !strings.Contains(index, `src="../.thumbs/1.png.jpg"`) || !strings.Contains(index, `id="search"`) {
+		t.Errorf("Wrong index:\n%s", index)
+	}
+	page := read("images/1.html")
+	for _, s := range []string{`src="../../1.png"`, `<td>42</td>`, `href="https://example.com/luna"`, `href="../tags/` + tagSlug("princess luna") + `.html"`, "Best pony", "&lt;3"} {
+		if !strings.Contains(page, s) {
+			t.Errorf("No %s in image page:\n%s", s, page)
+		}
+	}
+	if video := read("images/2.html"); !strings.Contains(video, `<video src="../../2.webm"`) {
+		t.Errorf("Video is not shown as one:\n%s", video)
+	}
+	if tag := read("tags/" + tagSlug("safe") + ".html"); strings.Count(tag, `data-id=`) != 2 {
+		t.Errorf("Wrong tag page:\n%s", tag)
+	}
+	if data := read("data.js"); !strings.Contains(data, `"1":["princess luna","safe"]`) {
+		t.Errorf("Wrong search data: %s", data)
+	}
+}
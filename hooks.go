@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//hookQueue is how many finished images may wait for their hook before downloads wait for hooks
+const hookQueue = 1024
+
+//hookOutputLimit is how much of what failed hook said is kept in report
+const hookOutputLimit = 1024
+
+//Names of hooks, as noted in report
+const (
+	hookComplete = "on-complete"
+	hookFinish   = "on-finish"
+)
+
+//hooks run user's commands on finished images and at the end of run. It is nil when there are no hooks,
+//all methods are fine with that
+var hooks *hookRunner
+
+//hookFailure is hook that failed, as noted in report. Image is downloaded all the same
+type hookFailure struct {
+	Hook  string `json:"hook"`
+	ID    int    `json:"id,omitempty"`
+	File  string `json:"file,omitempty"`
+	Error string `json:"error"`
+}
+
+//hookImage is what on-complete hook gets on stdin
+type hookImage struct {
+	ID      int       `json:"id"`
+	File    string    `json:"file"`
+	Path    string    `json:"path"`
+	URL     string    `json:"url"`
+	Tags    []string  `json:"tags"`
+	Source  string    `json:"source,omitempty"`
+	Format  string    `json:"format"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	Score   int       `json:"score"`
+	Faves   int       `json:"faves"`
+	Bytes   int64     `json:"bytes"`
+	Created time.Time `json:"created_at"`
+}
+
+type hookRunner struct {
+	ctx      context.Context
+	complete []string //Command split into words, placeholders not yet filled in
+	finish   []string
+	timeout  time.Duration
+	dir      string //Target directory, empty when images go somewhere else and have no path of their own
+	queue    chan hookImage
+	wg       sync.WaitGroup
+}
+
+//splitCommand splits command into words as shell would, minding quotes and backslashes. Nothing else
+//of shell is there: command is run as is, so whatever is put into placeholders can't be taken for shell syntax
+func splitCommand(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, escaped := false, false
+	var quote rune
+	for _, r := range command {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unfinished quote in command " + command)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+//fillIn puts values in place of {placeholders} in every word of command
+func fillIn(words []string, values map[string]string) []string {
+	pairs := make([]string, 0, 2*len(values))
+	for k, v := range values {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	r := strings.NewReplacer(pairs...)
+	res := make([]string, len(words))
+	for i, w := range words {
+		res[i] = r.Replace(w)
+	}
+	return res
+}
+
+//newHookRunner starts workers for on-complete hook, as many as could run at once. Cancelling context kills running hooks
+func newHookRunner(ctx context.Context, opts *HookOpts, dir string) (*hookRunner, error) {
+	h := &hookRunner{ctx: ctx, timeout: opts.HookTimeout, dir: dir}
+	var err error
+	if h.complete, err = splitCommand(opts.OnComplete); err != nil {
+		return nil, err
+	}
+	if h.finish, err = splitCommand(opts.OnFinish); err != nil {
+		return nil, err
+	}
+	jobs := opts.HookJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	if len(h.complete) != 0 {
+		h.queue = make(chan hookImage, hookQueue)
+		for i := 0; i < jobs; i++ {
+			h.wg.Add(1)
+			go func() {
+				defer h.wg.Done()
+				for img := range h.queue {
+					h.runComplete(img)
+				}
+			}()
+		}
+	}
+	return h, nil
+}
+
+//run runs single hook with timeout. Output is logged, and kept in error when hook fails
+func (h *hookRunner) run(words []string, env []string, stdin []byte) error {
+	ctx, cancel := context.WithTimeout(h.ctx, h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, words[0], words[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+
+	err := cmd.Run()
+	said := strings.TrimSpace(out.String())
+	if len(said) > hookOutputLimit {
+		said = "..." + said[len(said)-hookOutputLimit:]
+	}
+	if said != "" {
+		lDetail("Hook", words[0], "said:", said)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", h.timeout)
+	}
+	if err != nil && said != "" {
+		err = fmt.Errorf("%v: %s", err, said)
+	}
+	return err
+}
+
+//completed queues on-complete hook for image that is saved
+func (h *hookRunner) completed(img Image, size int64) {
+	if h == nil || h.queue == nil {
+		return
+	}
+	hi := hookImage{ID: img.Imgid, File: img.Filename, Path: img.Filename, Tags: splitTags(img.Tags), Source: img.Source, Format: img.Format,
+		Width: img.Width, Height: img.Height, Score: img.Score, Faves: img.Faves, Bytes: size, Created: img.Created}
+	if img.URL != nil {
+		hi.URL = img.URL.String()
+	}
+	if h.dir != "" {
+		hi.Path = constructFilepath(img.Filename, h.dir)
+	}
+	h.queue <- hi
+}
+
+func (h *hookRunner) runComplete(img hookImage) {
+	if h.ctx.Err() != nil {
+		return
+	}
+	stdin, err := json.Marshal(img)
+	if err == nil {
+		words := fillIn(h.complete, map[string]string{"path": img.Path, "id": strconv.Itoa(img.ID), "file": img.File})
+		env := []string{
+			"PONY_ID=" + strconv.Itoa(img.ID),
+			"PONY_FILE=" + img.File,
+			"PONY_PATH=" + img.Path,
+			"PONY_URL=" + img.URL,
+			"PONY_TAGS=" + strings.Join(img.Tags, ", "),
+			"PONY_SOURCE=" + img.Source,
+			"PONY_FORMAT=" + img.Format,
+			"PONY_SCORE=" + strconv.Itoa(img.Score),
+			"PONY_FAVES=" + strconv.Itoa(img.Faves),
+			"PONY_BYTES=" + strconv.FormatInt(img.Bytes, 10),
+		}
+		err = h.run(words, env, stdin)
+	}
+	if err != nil {
+		lErr("Hook", hookComplete, "failed for image", img.ID, err)
+		report.hookFailed(hookFailure{Hook: hookComplete, ID: img.ID, File: img.File, Error: err.Error()})
+	}
+}
+
+//wait lets on-complete hooks in queue finish
+func (h *hookRunner) wait() {
+	if h == nil || h.queue == nil {
+		return
+	}
+	close(h.queue)
+	h.wg.Wait()
+	h.queue = nil
+}
+
+//wantsReport tells if on-finish hook is there to get report
+func (h *hookRunner) wantsReport() bool {
+	return h != nil && len(h.finish) != 0
+}
+
+//finished runs on-finish hook with report of the run, already written into file. Returns false if hook failed
+func (h *hookRunner) finished(reportPath string, code int) bool {
+	if !h.wantsReport() {
+		return true
+	}
+	stdin, err := ioutil.ReadFile(reportPath)
+	if err == nil {
+		words := fillIn(h.finish, map[string]string{"report": reportPath})
+		err = h.run(words, []string{"PONY_REPORT=" + reportPath, "PONY_EXIT_CODE=" + strconv.Itoa(code)}, stdin)
+	}
+	if err != nil {
+		lErr("Hook", hookFinish, "failed:", err)
+		report.hookFailed(hookFailure{Hook: hookFinish, Error: err.Error()})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for in, exp := range map[string][]string{
+		"notify {path} {id}":          {"notify", "{path}", "{id}"},
+		`sh -c 'echo "$PONY_ID" > x'`: {"sh", "-c", `echo "$PONY_ID" > x`},
+		`cp "{path}" my\ pics/`:       {"cp", "{path}", "my pics/"},
+		`  spaced   out  `:            {"spaced", "out"},
+		`empty "" arg`:                {"empty", "", "arg"},
+		"":                            nil,
+	} {
+		got, err := splitCommand(in)
+		if err != nil || !reflect.DeepEqual(got, exp) {
+			t.Errorf("%q: expected %q, got %q, %v", in, exp, got, err)
+		}
+	}
+	if _, err := splitCommand(`echo 'unfinished`); err == nil {
+		t.Error("Unfinished quote is not an error")
+	}
+}
+
+func TestFillIn(t *testing.T) {
+	got := fillIn([]string{"cp", "{path}", "/pics/{id}-{file}"}, map[string]string{"path": "/a b/1.png", "id": "1", "file": "1.png"})
+	if exp := []string{"cp", "/a b/1.png", "/pics/1-1.png"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+}
+
+func TestHookRunner(t *testing.T) {
+	dir := t.TempDir()
+	oldReport := report
+	report = newRunReport()
+	defer func() { report = oldReport }()
+
+	h, err := newHookRunner(context.Background(), &HookOpts{
+		OnComplete:  `sh -c 'cat > "$1.json"; echo "$PONY_ID $PONY_TAGS" > "$1.env"; test "$PONY_ID" != 3' hook {path}`,
+		OnFinish:    `sh -c 'echo "$PONY_EXIT_CODE" > "$1.done"; exit 1' hook {report}`,
+		HookTimeout: time.Minute,
+		HookJobs:    2,
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.completed(Image{Imgid: 1, Filename: "1.png", Tags: "safe, pony"}, 10)
+	h.completed(Image{Imgid: 3, Filename: "3.png"}, 10)
+	h.wait()
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "1.png.json"))
+	if err != nil || !strings.Contains(string(raw), `"tags":["safe","pony"]`) {
+		t.Errorf("Hook got wrong stdin: %s, %v", raw, err)
+	}
+	raw, err = ioutil.ReadFile(filepath.Join(dir, "1.png.env"))
+	if err != nil || string(raw) != "1 safe, pony\n" {
+		t.Errorf("Hook got wrong environment: %q, %v", raw, err)
+	}
+
+	rp := filepath.Join(dir, "report.json")
+	if err = report.write(rp); err != nil {
+		t.Fatal(err)
+	}
+	if h.finished(rp, exitPartial) {
+		t.Error("Failed on-finish hook is taken for success")
+	}
+	if raw, err = ioutil.ReadFile(rp + ".done"); err != nil || string(raw) != "2\n" {
+		t.Errorf("On-finish hook got wrong exit code: %q, %v", raw, err)
+	}
+
+	if len(report.Hooks) != 2 || report.Hooks[0].ID != 3 || report.Hooks[1].Hook != hookFinish {
+		t.Errorf("Wrong failures in report: %+v", report.Hooks)
+	}
+	if code := report.finish(false); code != exitOK {
+		t.Errorf("Failed hooks changed exit code to %d", code)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	h := &hookRunner{ctx: context.Background(), timeout: 50 * time.Millisecond}
+	err := h.run([]string{"sleep", "5"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+}
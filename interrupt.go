@@ -1,43 +1,57 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
-var (
-	interrupter = make(chan struct{}, 1)
-)
+//handleInterrupts sets up what happens when user presses Ctrl-C. First time, stop is cancelled:
+//no new pages are searched and no new downloads are started, but ones in progress are finished.
+//Second time, abort is cancelled and downloads in progress are dropped, with their partial files.
+//Third time we don't wait for anything
+func handleInterrupts() (stop, abort context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
-func init() {
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+	abort, cancelAbort := context.WithCancel(context.Background())
+	stop, cancelStop := context.WithCancel(abort) //Aborting means stopping too
 
 	go func() {
 		<-sig
-		close(interrupter)
+		lWarn("Interrupted, finishing downloads in progress. Interrupt again to abort them")
+		cancelStop()
+		<-sig
+		lWarn("Aborting downloads in progress")
+		cancelAbort()
 		<-sig
 		lDone("Program interrupted by user's command")
-		os.Exit(0)
+		os.Exit(exitInterrupted)
 	}()
+
+	return stop, abort
 }
 
-func interrupt(imgchan <-chan Image) (outch chan Image) {
+//interrupt passes images along until stop, then closes output, dropping whatever was left in the queue
+func interrupt(ctx context.Context, imgchan <-chan Image) (outch chan Image) {
 	outch = make(chan Image)
 	go func() {
+		defer close(outch)
 		for {
 			select {
-			case <-interrupter:
-				close(outch)
+			case <-ctx.Done():
 				return
 
 			case img, ok := <-imgchan:
 				if !ok {
-					close(outch)
-					imgchan = nil
 					return
 				}
-				outch <- img
+				select {
+				case outch <- img:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -45,11 +59,12 @@ func interrupt(imgchan <-chan Image) (outch chan Image) {
 	return outch
 }
 
-func isInterrupted() bool {
+//send puts image into channel unless we were stopped while waiting. Returns false if stopped
+func send(ctx context.Context, imgchan chan<- Image, img Image) bool {
 	select {
-	case <-interrupter:
+	case imgchan <- img:
 		return true
-	default:
+	case <-ctx.Done():
 		return false
 	}
 }
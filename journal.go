@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//journalName is file in target directory where failed downloads are noted, one JSON per line
+const journalName = "failed.jsonl"
+
+//journal remembers failed downloads between runs. It is nil when there is nowhere to write it, all methods are fine with that
+var journal *failJournal
+
+//Classes of errors, so it is visible at a glance what went wrong and if retrying makes sense
+const (
+	classNetwork     = "network"
+	classServer      = "server"
+	classDisk        = "disk"
+	classIncomplete  = "incomplete"
+	classInterrupted = "interrupted"
+	classOther       = "other"
+)
+
+//errIncomplete is when server gave us less than it promised
+var errIncomplete = errors.New("incomplete download")
+
+//statusError is server refusing to give us image
+type statusError struct {
+	Status string
+}
+
+func (e *statusError) Error() string {
+	return "server response: " + e.Status
+}
+
+//failure is single failed download, as noted in journal
+type failure struct {
+	ID    int       `json:"id"`
+	File  string    `json:"file"`
+	Class string    `json:"class"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+//failJournal keeps failures on disk as they happen and drops ones that were fixed when closed
+type failJournal struct {
+	mu      sync.Mutex
+	path    string
+	out     *os.File
+	entries map[string]failure //By file, because single ID may bring several files
+	dirty   bool
+}
+
+//errorClass sorts error of download into one of the classes
+func errorClass(err error) string {
+	var uerr *url.Error
+	var nerr net.Error
+	var serr *statusError
+	var perr *os.PathError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return classInterrupted
+	case errors.Is(err, errIncomplete):
+		return classIncomplete
+	case errors.As(err, &serr):
+		return classServer
+	case errors.As(err, &perr):
+		return classDisk
+	case errors.As(err, &uerr), errors.As(err, &nerr):
+		return classNetwork
+	default:
+		return classOther
+	}
+}
+
+//openJournal reads what failed before and gets ready to note new failures
+func openJournal(dir string) (*failJournal, error) {
+	j := &failJournal{path: constructFilepath(journalName, dir)}
+
+	entries, err := readJournal(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	j.entries = make(map[string]failure, len(entries))
+	for _, f := range entries {
+		j.entries[f.File] = f
+	}
+
+	j.out, err = os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+//readJournal gets all failures noted in journal file. Later notes about the same file win
+func readJournal(path string) ([]failure, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close() //Read-only, nothing to lose
+
+	byFile := make(map[string]failure)
+	var order []string
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		var f failure
+		if err := json.Unmarshal(sc.Bytes(), &f); err != nil {
+			lWarn("Skipping broken line in", path)
+			continue
+		}
+		if _, ok := byFile[f.File]; !ok {
+			order = append(order, f.File)
+		}
+		byFile[f.File] = f
+	}
+
+	res := make([]failure, 0, len(order))
+	for _, file := range order {
+		res = append(res, byFile[file])
+	}
+	return res, sc.Err()
+}
+
+//failedIDs are unique IDs of images in journal, in order of appearance
+func failedIDs(entries []failure) []int {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, f := range entries {
+		if !seen[f.ID] {
+			seen[f.ID] = true
+			ids = append(ids, f.ID)
+		}
+	}
+	return ids
+}
+
+//failed notes that image failed to download, right away, so it is remembered even if we die
+func (j *failJournal) failed(img Image, err error) {
+	if j == nil {
+		return
+	}
+	f := failure{ID: img.Imgid, File: img.Filename, Class: errorClass(err), Error: err.Error(), Time: time.Now()}
+	line, merr := json.Marshal(f)
+	if merr != nil {
+		lErr("Could not note failure in journal: ", merr)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries[f.File] = f
+	if _, werr := j.out.Write(append(line, '\n')); werr != nil {
+		lErr("Could not note failure in journal: ", werr)
+	}
+}
+
+//succeeded forgets previous failures of image file, if there were any
+func (j *failJournal) succeeded(img Image) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.entries[img.Filename]; ok {
+		delete(j.entries, img.Filename)
+		j.dirty = true
+	}
+}
+
+//close rewrites journal without failures that were fixed. Empty journal is removed
+func (j *failJournal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.out.Close(); err != nil {
+		return err
+	}
+	if !j.dirty {
+		return nil
+	}
+	if len(j.entries) == 0 {
+		return os.Remove(j.path)
+	}
+
+	entries := make([]failure, 0, len(j.entries))
+	for _, f := range j.entries {
+		entries = append(entries, f)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Time.Before(entries[b].Time) })
+
+	tmp := j.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for _, f := range entries {
+		if err = enc.Encode(f); err != nil {
+			_ = out.Close() //First error is more interesting
+			return err
+		}
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path) //Old journal stays whole until new one is ready
+}
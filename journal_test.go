@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	cases := map[error]string{
+		context.Canceled:                                 classInterrupted,
+		&statusError{"404 Not Found"}:                    classServer,
+		fmt.Errorf("%w, got 1", errIncomplete):           classIncomplete,
+		&os.PathError{Op: "open", Err: os.ErrPermission}: classDisk,
+		errors.New("who knows"):                          classOther,
+	}
+	for err, class := range cases {
+		if c := errorClass(err); c != class {
+			t.Error("Error ", err, " classified as ", c, " instead of ", class)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.failed(Image{Imgid: 1, Filename: "1.png"}, &statusError{"502 Bad Gateway"})
+	j.failed(Image{Imgid: 2, Filename: "2.webm"}, context.Canceled)
+	j.failed(Image{Imgid: 2, Filename: "2.mp4"}, context.Canceled)
+	if err = j.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readJournal(filepath.Join(dir, journalName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := failedIDs(entries); len(entries) != 3 || len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatal("Journal remembers wrong: ", entries)
+	}
+	if entries[0].Class != classServer {
+		t.Error("Journal lost class of failure: ", entries[0])
+	}
+
+	j, err = openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.succeeded(Image{Imgid: 1, Filename: "1.png"})
+	j.succeeded(Image{Imgid: 2, Filename: "2.webm"})
+	if err = j.close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ = readJournal(filepath.Join(dir, journalName)); len(entries) != 1 || entries[0].File != "2.mp4" {
+		t.Error("Journal didn't forget fixed failures: ", entries)
+	}
+
+	j, _ = openJournal(dir)
+	j.succeeded(Image{Imgid: 2, Filename: "2.mp4"})
+	if err = j.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, journalName)); !os.IsNotExist(err) {
+		t.Error("Empty journal is left behind")
+	}
+}
+
+func TestIDsFromArgs(t *testing.T) {
+	ids, rest := idsFromArgs([]string{"415147", "luna", "2"})
+	if len(ids) != 2 || ids[1] != 2 || len(rest) != 1 || rest[0] != "luna" {
+		t.Error("IDs picked wrong: ", ids, rest)
+	}
+}
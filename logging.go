@@ -1,80 +1,284 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+//logLevel is how important log record is. Records less important than configured level are dropped
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]logLevel{"info": levelInfo, "warn": levelWarn, "error": levelError}
+
+//logFields are structured bits of record, like image_id or bytes. In text they are already a part of message,
+//except for error, which is appended to it. In JSON they go as they are
+type logFields map[string]interface{}
+
+//logKind is what sort of record that is, it decides prefix, level and where record is shown
+type logKind struct {
+	prefix string
+	name   string
+	level  logLevel
+	caller bool //Whether to note file and line record came from
+	detail bool //Records about every single image, not shown on console when progress view is there
+	stderr bool
+}
+
 var (
-	doneLogger *log.Logger
-	infoLogger *log.Logger
-	errLogger  *log.Logger
-	warnLogger *log.Logger
+	kindDone   = logKind{prefix: "Done at ", name: "done", level: levelInfo}
+	kindInfo   = logKind{prefix: "Happened at ", name: "info", level: levelInfo}
+	kindDetail = logKind{prefix: "Happened at ", name: "info", level: levelInfo, detail: true}
+	kindWarn   = logKind{prefix: "Warning at ", name: "warn", level: levelWarn, caller: true, stderr: true}
+	kindErr    = logKind{prefix: "Error at ", name: "error", level: levelError, caller: true, stderr: true}
 )
 
-//Setting up logfile as I want it to: Copy to event.log, copy to command line
+//logger writes every record into logfile and on console. It is global, same as log package's
+var logger = &eventLogger{
+	format:  "text",
+	console: os.Stdout,
+	errout:  os.Stderr,
+	details: true,
+}
+
+type eventLogger struct {
+	mu      sync.Mutex
+	format  string
+	level   logLevel
+	file    io.WriteCloser //nil when logfile is disabled
+	console io.Writer
+	errout  io.Writer
+	details bool //Whether records about every single image go on console
+}
+
+//Setting up logfile as I want it to: Copy to event.log, copy to command line. Configuration comes later, when we know it
 //Sometimes you just look at available packages and feel that you must roll out your own solution
 func init() {
-
-	logfile := &lumberjack.Logger{
+	logger.file = &lumberjack.Logger{
 		Filename:   "event.log",
 		MaxSize:    1, // megabytes
 		MaxBackups: 9,
 		MaxAge:     28, //days
 	}
+}
 
-	infoLog := io.MultiWriter(logfile, os.Stdout)
-	errLog := io.MultiWriter(logfile, os.Stderr)
+//setupLogging applies logging options from configuration. Options that are not set anywhere get their defaults here,
+//and so they get written into config.ini
+func setupLogging(sets *Config) error {
+	if sets.LogFile == "" {
+		sets.LogFile = "event.log"
+	}
+	if sets.LogFormat == "" {
+		sets.LogFormat = "text"
+	}
+	if sets.LogLevel == "" {
+		sets.LogLevel = "info"
+	}
+	if sets.LogMaxSize <= 0 {
+		sets.LogMaxSize = 1
+	}
+	if sets.LogBackups <= 0 {
+		sets.LogBackups = 9
+	}
+	if sets.LogMaxAge <= 0 {
+		sets.LogMaxAge = 28
+	}
+
+	level, ok := levelNames[sets.LogLevel]
+	if !ok {
+		return fmt.Errorf("unknown log level %s", sets.LogLevel)
+	}
+
+	var file io.WriteCloser
+	if sets.LogFile != "none" {
+		file = &lumberjack.Logger{
+			Filename:   filepath.Clean(sets.LogFile),
+			MaxSize:    sets.LogMaxSize,
+			MaxBackups: sets.LogBackups,
+			MaxAge:     sets.LogMaxAge,
+		}
+	}
 
-	doneLogger = log.New(infoLog, "Done at ", log.LstdFlags)
-	infoLogger = log.New(infoLog, "Happened at ", log.LstdFlags)
-	warnLogger = log.New(errLog, "Warning at ", log.LstdFlags|log.Lshortfile)
-	errLogger = log.New(errLog, "Error at ", log.LstdFlags|log.Lshortfile)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if logger.file != nil {
+		_ = logger.file.Close() //Closing file that was never opened is fine, and nothing else could happen with it
+	}
+	logger.file = file
+	logger.format = sets.LogFormat
+	logger.level = level
+	return nil
+}
+
+//logToStderr moves console part of all logs to stderr, leaving stdout clean for program output
+func logToStderr() {
+	logger.mu.Lock()
+	logger.console = os.Stderr
+	logger.mu.Unlock()
+}
+
+//logThrough sends console part of all logs through given writers, and keeps details about every image for logfile only
+func logThrough(console, errout io.Writer) {
+	logger.mu.Lock()
+	logger.console = console
+	logger.errout = errout
+	logger.details = false
+	logger.mu.Unlock()
+}
+
+//output formats record and writes it wherever it should go. Calldepth is counted from caller of output
+func (l *eventLogger) output(calldepth int, kind logKind, fields logFields, msg string) {
+	now := time.Now()
+
+	caller := ""
+	if kind.caller {
+		if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+			caller = filepath.Base(file) + ":" + fmt.Sprint(line)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if kind.level < l.level {
+		return
+	}
+
+	var rec []byte
+	if l.format == "json" {
+		rec = jsonRecord(now, kind, caller, fields, msg)
+	} else {
+		rec = textRecord(now, kind, caller, fields, msg)
+	}
+
+	if l.file != nil {
+		_, _ = l.file.Write(rec) //Following log package, ignoring error value
+	}
+	if kind.detail && !l.details {
+		return
+	}
+	if kind.stderr {
+		_, _ = l.errout.Write(rec)
+	} else {
+		_, _ = l.console.Write(rec)
+	}
+}
+
+//textRecord looks the same as log package would make it
+func textRecord(now time.Time, kind logKind, caller string, fields logFields, msg string) []byte {
+	var b strings.Builder
+	b.WriteString(kind.prefix)
+	b.WriteString(now.Format("2006/01/02 15:04:05 "))
+	if caller != "" {
+		b.WriteString(caller)
+		b.WriteString(": ")
+	}
+	b.WriteString(msg)
+	if err, ok := fields["error"]; ok {
+		fmt.Fprint(&b, ": ", err)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+//jsonRecord is a line of JSON, with time, level, message and fields
+func jsonRecord(now time.Time, kind logKind, caller string, fields logFields, msg string) []byte {
+	rec := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error() //Errors don't marshal themselves
+		}
+		rec[k] = v
+	}
+	rec["time"] = now.Format(time.RFC3339Nano)
+	rec["level"] = kind.name
+	rec["msg"] = msg
+	if caller != "" {
+		rec["caller"] = caller
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil { //Some field is unmarshallable, message itself is still worth having
+		line, _ = json.Marshal(map[string]string{"time": now.Format(time.RFC3339Nano), "level": kind.name, "msg": msg})
+	}
+	return append(line, '\n')
+}
+
+//sprintln is fmt.Sprintln without newline at the end, so Println-like wrappers could pass it along
+func sprintln(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
 }
 
 //Wrappers for loggers to simplify invocation and don't suffer premade packages
 //lInfo logs generic necessary program flow
 func lInfo(v ...interface{}) {
-	infoLogger.Println(v...)
+	logger.output(1, kindInfo, nil, sprintln(v...))
+}
+
+//lInfow logs generic program flow with structured fields
+func lInfow(msg string, fields logFields) {
+	logger.output(1, kindInfo, fields, msg)
 }
 
 //lCondInfo doesn't log when it's disalbed
 func lCondInfo(on bool, v ...interface{}) {
 	if on {
-		infoLogger.Println(v...)
+		logger.output(1, kindInfo, nil, sprintln(v...))
 	}
 }
 
 //lInfof logs generic program flow with ability to format string beyond defaults
-//Used only to note downloading speed and timing
+//Used to sum up downloads
 func lInfof(format string, v ...interface{}) {
-	infoLogger.Printf(format, v...)
+	logger.output(1, kindInfo, nil, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+//lDetail logs what happens to every single image
+func lDetail(v ...interface{}) {
+	logger.output(1, kindDetail, nil, sprintln(v...))
+}
+
+//lDetailw logs what happens to every single image, with structured fields. Used to note downloading speed and timing
+func lDetailw(msg string, fields logFields) {
+	logger.output(1, kindDetail, fields, msg)
 }
 
 //lDone notes that we are finished and there is nothing left to do, sane way
 func lDone(v ...interface{}) {
-	doneLogger.Println(v...)
+	logger.output(1, kindDone, nil, sprintln(v...))
 }
 
 //lErr notes non-fatal error and usually continues trying to crunch on
 func lErr(v ...interface{}) {
-	/* #nosec */
-	_ = errLogger.Output(2, fmt.Sprintln(v...)) //Following log package, ignoring error value
+	logger.output(1, kindErr, nil, sprintln(v...))
+}
+
+//lErrw notes non-fatal error with structured fields. Error itself goes as "error" field
+func lErrw(msg string, fields logFields) {
+	logger.output(1, kindErr, fields, msg)
 }
 
 //lFatal happens when suffer some kind of error and we can't recover
 func lFatal(v ...interface{}) {
-	/* #nosec */
-	_ = errLogger.Output(2, fmt.Sprintln(v...)) //Following log package, ignoring error value
-	os.Exit(1)
+	logger.output(1, kindErr, nil, sprintln(v...))
+	os.Exit(exitFatal)
 }
 
 //lWarn is when there is no noticeable error, but something suspicious still happed
 func lWarn(v ...interface{}) {
-	/* #nosec */
-	_ = warnLogger.Output(2, fmt.Sprintln(v...)) //Following log package, ignoring error value
+	logger.output(1, kindWarn, nil, sprintln(v...))
 }
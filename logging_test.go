@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextRecord(t *testing.T) {
+	now := time.Date(2017, 12, 20, 3, 44, 27, 0, time.UTC)
+	rec := string(textRecord(now, kindErr, "query.go:42", logFields{"image_id": 1, "error": errors.New("boom")}, "Unable to write image on disk"))
+	if rec != "Error at 2017/12/20 03:44:27 query.go:42: Unable to write image on disk: boom\n" {
+		t.Errorf("Got %q", rec)
+	}
+}
+
+func TestJSONRecord(t *testing.T) {
+	now := time.Date(2017, 12, 20, 3, 44, 27, 0, time.UTC)
+	rec := jsonRecord(now, kindDetail, "", logFields{"image_id": 1605729, "bytes": int64(1056255), "duration": 0.35, "error": errors.New("boom")}, "Downloaded")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(rec, &got); err != nil {
+		t.Fatal("Record is not JSON: ", err)
+	}
+	want := map[string]interface{}{
+		"time": "2017-12-20T03:44:27Z", "level": "info", "msg": "Downloaded",
+		"image_id": 1605729.0, "bytes": 1056255.0, "duration": 0.35, "error": "boom",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Field %s: expected %v, got %v", k, v, got[k])
+		}
+	}
+	if _, ok := got["caller"]; ok {
+		t.Error("Caller is noted when it was not asked for")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var file, console bytes.Buffer
+	l := &eventLogger{format: "json", level: levelWarn, file: nopCloser{&file}, console: &console, errout: &console, details: false}
+
+	l.output(0, kindInfo, nil, "info")
+	l.output(0, kindDetail, logFields{"image_id": 1}, "detail")
+	l.output(0, kindWarn, nil, "warn")
+	if strings.Contains(file.String(), "info") || strings.Count(file.String(), "\n") != 1 {
+		t.Errorf("Records below level are not dropped: %q", file.String())
+	}
+
+	l.level = levelInfo
+	l.output(0, kindDetail, logFields{"image_id": 1}, "detail")
+	if !strings.Contains(file.String(), `"image_id":1`) {
+		t.Errorf("Detail is not in file: %q", file.String())
+	}
+	if strings.Contains(console.String(), "detail") {
+		t.Errorf("Detail is on console when it should not be: %q", console.String())
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	file, format, level := logger.file, logger.format, logger.level
+	defer func() {
+		logger.file, logger.format, logger.level = file, format, level
+	}()
+	logger.file = nil
+
+	sets := &Config{LogFile: "none", LogLevel: "error"}
+	if err := setupLogging(sets); err != nil {
+		t.Fatal(err)
+	}
+	if logger.file != nil {
+		t.Error("Log file is set up when it's disabled")
+	}
+	if logger.level != levelError || logger.format != "text" {
+		t.Errorf("Got level %d and format %s", logger.level, logger.format)
+	}
+	if sets.LogMaxSize != 1 || sets.LogBackups != 9 || sets.LogMaxAge != 28 {
+		t.Errorf("Defaults are not filled in: %+v", sets)
+	}
+	if err := setupLogging(&Config{LogLevel: "loud"}); err == nil {
+		t.Error("Unknown level is accepted")
+	}
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -3,12 +3,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 )
 
 func main() {
-	fmt.Printf("Derpibooru.org Downloader, version %s\n\n", version)
+	fmt.Fprintf(os.Stderr, "Derpibooru.org Downloader, version %s\n\n", version) //Stdout could be taken by image list
 
 	opts, lostArgs := getOptions()
 
@@ -17,50 +19,259 @@ func main() {
 	if len(lostArgs) != 0 {
 		lErr("Too many arguments, skipping following:", lostArgs)
 	}
+
+	switch opts.command {
+	case "retry-failed":
+		os.Exit(retryFailed(opts))
+	case "dedupe":
+		os.Exit(dedupe(opts))
+	case "similar":
+		os.Exit(similarCmd(opts))
+	case "export-hydrus":
+		os.Exit(hydrusCmd(opts))
+	case "export-dataset":
+		os.Exit(datasetCmd(opts))
+	case "gallery-html":
+		os.Exit(galleryCmd(opts))
+	case "serve":
+		os.Exit(serveCmd(opts))
+	}
+
+	if opts.Resume {
+		resumeSearch(opts)
+	}
+
 	//If no arguments after flags and empty/unchanged tag, what we should download? Sane end of line.
 	if len(opts.Args.IDs) == 0 && opts.Tag == "" {
 		lDone("Nothing to download, bye!")
 		return
 	}
 
+	os.Exit(run(opts, func(stop context.Context, imgdat chan<- Image) {
+		if opts.Tag == "" { //Because we can put Image ID with flags. Why not?
+
+			if len(opts.Args.IDs) == 1 {
+				lInfo("Processing image №", opts.Args.IDs[0])
+			} else {
+				lInfo("Processing images №", debracket(opts.Args.IDs))
+			}
+			go ParseImg(stop, imgdat, opts.Args.IDs, opts.Key) // Sending Image ID to parser. Here validity is our problem
+
+		} else {
+
+			// And here we send tags to getter/parser. Query and JSON validity is mostly server problem
+			// Server response validity is ours
+			lInfo("Processing tags", opts.Tag)
+			checkpoint = newCheckpoint(opts.ImageDir, opts.Tag, opts.resume, opts.DryRun)
+			go ParseTag(stop, imgdat, opts.TagOpts, opts.FiltOpts, opts.Key)
+		}
+	}))
+}
+
+//run sets up console, metrics and interrupts around pipeline and tells user how it went. Returns exit code
+func run(opts *Options, parse func(stop context.Context, imgdat chan<- Image)) int {
+
 	if opts.UnsafeHTTPS {
 		makeHTTPSUnsafe()
 	}
 
+	if opts.DryRun || opts.OutputArchive == "-" {
+		logToStderr() //Image list or archive goes to stdout and shouldn't be mixed with anything
+	} else if isTerminal(os.Stdout) {
+		progress = newProgressView(os.Stdout, workers)
+		logThrough(progress, progress.aside(os.Stderr)) //Log lines are printed above bars, errors still go into stderr. Logfile doesn't get any of drawing
+	}
+
+	if opts.MetricsAddr != "" {
+		srv, err := serveMetrics(opts.MetricsAddr)
+		if err != nil {
+			lFatal("Could not serve metrics: ", err)
+		}
+		defer srv.Close() //Last scrape may miss the end of run, nothing to do about it
+	}
+
+	stop, abort := handleInterrupts() //Ctrl-C stops us gracefully first, then not so gracefully
+	code, err := pipeline(stop, abort, opts, parse)
+	if err != nil {
+		lFatal(err)
+	}
+
+	switch code {
+	case exitInterrupted:
+		lDone("Program interrupted by user's command")
+	case exitAPIUnreachable:
+		lDone("Could not get anything from Derpibooru")
+	case exitPartial:
+		lDone("Finished, but not everything went well")
+	default:
+		lDone("Finished")
+	}
+	return code
+}
+
+//pipeline opens target directory, lets parse start parsers, filters what they send and downloads or lists it,
+//then closes everything and writes report. Stop ends search, abort drops downloads in progress. Returns exit code.
+//Error is when run couldn't even start, nothing is opened then. Server goes on with next job, so it's up to caller to die
+func pipeline(stop, abort context.Context, opts *Options, parse func(stop context.Context, imgdat chan<- Image)) (int, error) {
+
 	//Creating directory for downloads if it does not yet exist. But allow dumping into current directory
-	if opts.ImageDir != "" {
+	if opts.ImageDir != "" && !opts.DryRun {
 		err := os.MkdirAll(opts.ImageDir, 0700)
 		if err != nil { //Execute bit means different thing for directories that for files. And I was stupid.
-			lFatal(err) //We can not create folder for images, end of line.
+			return exitFatal, err //We can not create folder for images, end of line.
 		}
 	}
 
-	//	Creating channels to pass info to downloader and to signal job well done
-	imgdat := make(chan Image, opts.QDepth) //Better leave default queue depth. Experiment shown that depth about 20 provides optimal performance on my system
+	var store Storage
+	if !opts.DryRun {
+		var err error
+		if store, err = openStorage(abort, opts); err != nil {
+			return exitFatal, fmt.Errorf("could not open storage for images: %w", err)
+		}
+	}
 
-	if opts.Tag == "" { //Because we can put Image ID with flags. Why not?
+	if (opts.OnComplete != "" || opts.OnFinish != "") && !opts.DryRun {
+		dir := ""
+		if toDirectory(opts) { //Files in archives and buckets have no path hook could open
+			dir = opts.ImageDir
+		}
+		var err error
+		if hooks, err = newHookRunner(abort, opts.HookOpts, dir); err != nil {
+			_ = store.Close() //Nothing was put there
+			return exitFatal, fmt.Errorf("could not understand hook command: %w", err)
+		}
+	}
 
-		if len(opts.Args.IDs) == 1 {
-			lInfo("Processing image №", opts.Args.IDs[0])
-		} else {
-			lInfo("Processing images №", debracket(opts.Args.IDs))
+	if !opts.DryRun {
+		var err error
+		journal, err = openJournal(opts.ImageDir)
+		if err != nil {
+			lErr("Could not open journal of failed downloads, they won't be remembered: ", err)
 		}
-		go ParseImg(imgdat, opts.Args.IDs, opts.Key) // Sending Image ID to parser. Here validity is our problem
+	}
 
-	} else {
+	if toDirectory(opts) { //Index is about target directory, archives and buckets are elsewhere
+		var err error
+		archive, err = openArchive(opts.ImageDir, opts.Dedupe) //Dry run needs it too, to skip similar images. Nothing is written then
+		if err != nil {
+			lErr("Could not read index of target directory, starting new one: ", err)
+			archive = newArchive(opts.ImageDir, opts.Dedupe)
+		}
+		if !opts.DryRun {
+			if catalogue, err = openCatalogue(opts.ImageDir); err != nil {
+				lErr("Could not open catalogue of target directory, new images won't be noted there: ", err)
+			}
+			if opts.WithComments {
+				threads = newCommentSaver(abort, opts.ImageDir, opts.Key, opts.CommentsHTML)
+			}
+		}
+	} else if opts.WithComments || opts.Thumbs > 0 {
+		lWarn("Comments and thumbnails are kept only in target directory, they are not saved into archives or buckets")
+	}
 
-		// And here we send tags to getter/parser. Query and JSON validity is mostly server problem
-		// Server response validity is ours
-		lInfo("Processing tags", opts.Tag)
-		go ParseTag(imgdat, opts.TagOpts, opts.Key)
+	if opts.Thumbs > 0 && toDirectory(opts) && !opts.DryRun {
+		thumbnailer = newThumbMaker(abort, opts.ImageDir, opts.Thumbs)
 	}
 
+	mediaOpts = opts.MediaOpts //Deciding what files every image brings before anything gets parsed
+
+	//	Creating channels to pass info to downloader and to signal job well done
+	imgdat := make(chan Image, opts.QDepth) //Better leave default queue depth. Experiment shown that depth about 20 provides optimal performance on my system
+
+	parse(stop, imgdat)
+
 	lInfo("Starting worker") //It would be funny if worker goroutine does not start
 
 	filterInit(opts.FiltOpts, bool(opts.Config.LogFilters)) //Initiating filters based on our given flags
-	filtimgdat := FilterChannel(imgdat)                     //Actual filtration
+	filtimgdat := FilterChannel(stop, imgdat)               //Actual filtration
+
+	if opts.DryRun {
+		listImages(interrupt(stop, filtimgdat), opts.Config, opts.ListFormat, os.Stdout) //Just looking
+	} else {
+		downloadImages(abort, interrupt(stop, filtimgdat), store) // Now that we got asynchronous list of images we want to get done, we can get them.
+		thumbnailer.close()
+		threads.close()
+		hooks.wait()
+		progress.close()
+		if err := store.Close(); err != nil {
+			lErr("Could not finish storing images: ", err)
+		}
+		if err := catalogue.categorize(stop, opts.Key); err != nil {
+			lErr("Could not learn categories of tags: ", err)
+		}
+	}
+
+	if err := checkpoint.close(); err != nil {
+		lErr("Could not remove checkpoint of finished search: ", err)
+	}
+
+	if err := archive.close(); err != nil {
+		lErr("Could not write index of target directory: ", err)
+	}
+
+	if err := catalogue.close(); err != nil {
+		lErr("Could not write catalogue of target directory: ", err)
+	}
 
-	downloadImages(interrupt(filtimgdat), opts.Config) // Now that we got asynchronous list of images we want to get done, we can get them.
+	if err := journal.close(); err != nil {
+		lErr("Could not update journal of failed downloads: ", err)
+	}
+
+	code := report.finish(stop.Err() != nil)
+	reportPath := opts.Report
+	if reportPath == "" && hooks.wantsReport() { //Hook gets report anyway, even if user doesn't keep it
+		if f, err := ioutil.TempFile("", "ponydownloader-report-*.json"); err != nil {
+			lErr("Could not make file for report: ", err)
+		} else {
+			_ = f.Close() //Empty, nothing to lose
+			reportPath = f.Name()
+			defer os.Remove(reportPath)
+		}
+	}
+	if reportPath != "" {
+		if err := report.write(reportPath); err != nil {
+			lErr("Could not write report: ", err)
+		}
+	}
+	if !hooks.finished(reportPath, code) && opts.Report != "" { //Failure of hook goes into report it was given
+		if err := report.write(opts.Report); err != nil {
+			lErr("Could not write report: ", err)
+		}
+	}
+	return code, nil
+}
+
+//resumeSearch picks up checkpoint left by previous run. Tag could be omitted, it is in checkpoint too
+func resumeSearch(opts *Options) {
+	st, err := loadCheckpoint(opts.ImageDir)
+	switch {
+	case os.IsNotExist(err):
+		lWarn("No checkpoint to resume, starting from the beginning")
+		return
+	case err != nil:
+		lFatal("Could not read checkpoint: ", err)
+	case opts.Tag == "":
+		opts.Tag = st.Query
+	case opts.Tag != st.Query:
+		lFatal("Checkpoint is for search", st.Query, "and not", opts.Tag)
+	}
+	opts.TagOpts.resume = st
+}
+
+//retryFailed feeds images that failed before back to downloader. Journal forgets them as they succeed
+func retryFailed(opts *Options) int {
+	entries, err := readJournal(constructFilepath(journalName, opts.ImageDir))
+	if err != nil && !os.IsNotExist(err) {
+		lFatal("Could not read journal of failed downloads: ", err)
+	}
+	if len(entries) == 0 {
+		lDone("Nothing to retry, bye!")
+		return exitOK
+	}
 
-	lDone("Finished")
+	ids := failedIDs(entries)
+	return run(opts, func(stop context.Context, imgdat chan<- Image) {
+		lInfo("Retrying images №", debracket(ids))
+		go ParseImg(stop, imgdat, ids, opts.Key)
+	})
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//knownFormats are original formats Derpibooru hosts
+var knownFormats = []string{"png", "jpeg", "gif", "svg", "webm", "mp4"}
+
+//mediaOpts decide which files are fetched for every image. Set once in main, before parsing starts
+var mediaOpts = &MediaOpts{SVG: "vector"}
+
+//FormatList is comma separated list of media formats, like "png,jpeg,gif". Flag could be repeated
+type FormatList []string
+
+//UnmarshalFlag implements flags.Unmarshaler interface for FormatList
+func (l *FormatList) UnmarshalFlag(value string) error {
+	for _, f := range strings.Split(value, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "jpg" {
+			f = "jpeg" //Everyone calls it jpg, Derpibooru doesn't
+		}
+		if f == "" {
+			continue
+		}
+		if !FormatList(knownFormats).has(f) {
+			return fmt.Errorf("`%s' is not a known format, try some of %s", f, strings.Join(knownFormats, ","))
+		}
+		*l = append(*l, f)
+	}
+	return nil
+}
+
+//MarshalFlag implements flags.Marshaler interface for FormatList
+func (l FormatList) MarshalFlag() (string, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l FormatList) has(format string) bool {
+	for _, f := range l {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+//isAnimated tells if format is, most likely, something that moves
+func isAnimated(format string) bool {
+	return format == "gif" || format == "webm" || format == "mp4"
+}
+
+//variants turns single image from API into all the files we want to save for it:
+//SVG could be saved as vector original, as PNG render or both, animations could bring their alternates along
+func variants(dat RawImage) []Image {
+	img := trim(dat)
+
+	if isResized() { //Renders are always raster and never move, nothing else to pick from
+		return []Image{img}
+	}
+
+	if dat.OriginalFormat == "svg" {
+		var res []Image
+		if mediaOpts.SVG != "raster" {
+			res = append(res, img)
+		}
+		if mediaOpts.SVG != "vector" {
+			res = append(res, img.alternate("png", alternateURL(dat, img.URL, "png")))
+		}
+		return res
+	}
+
+	res := []Image{img}
+	if isAnimated(dat.OriginalFormat) {
+		for _, f := range mediaOpts.AnimatedAlt {
+			if f == dat.OriginalFormat {
+				continue
+			}
+			res = append(res, img.alternate(f, alternateURL(dat, img.URL, f)))
+		}
+	}
+	return res
+}
+
+//alternate is the same image in other format, saved under its own name
+func (imgdata Image) alternate(format string, u *url.URL) Image {
+	imgdata.Filename = strconv.Itoa(imgdata.Imgid) + "." + format
+	imgdata.URL = u
+	imgdata.Size = 0 //API knows size only of original
+	return imgdata
+}
+
+//alternateURL looks for format among representations server told us about. If there is none, guesses
+//by changing extension of original, the way Derpibooru names its renders
+func alternateURL(dat RawImage, orig *url.URL, format string) *url.URL {
+	for _, key := range []string{format, "full"} {
+		rep, ok := dat.Representations[key]
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(rep)
+		if err != nil || path.Ext(u.Path) != "."+format {
+			continue
+		}
+		u.Scheme = derpiURL.Scheme
+		return u
+	}
+
+	u := *orig
+	u.Path = strings.TrimSuffix(u.Path, path.Ext(u.Path)) + "." + format
+	return &u
+}
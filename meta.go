@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//metaMarker is in everything we embed, so it could be found and taken out again, giving back original file byte for byte
+const metaMarker = "https://github.com/NHOrus/ponydownloader/ns/1.0/"
+
+//errNoRoom is when file can't take metadata without changing what is already there
+var errNoRoom = errors.New("no room for metadata in this file")
+
+//imageMeta is what gets embedded into image
+type imageMeta struct {
+	ID     int
+	URL    string
+	Source string
+	Artist []string
+	Tags   []string
+}
+
+//metaFor collects what is known about image. Artists are tags like artist:name
+func metaFor(img Image) imageMeta {
+	m := imageMeta{ID: img.Imgid, URL: derpiURL.Scheme + "://" + derpiURL.Host + "/" + strconv.Itoa(img.Imgid), Source: img.Source}
+	for _, tag := range strings.Split(img.Tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		m.Tags = append(m.Tags, tag)
+		if strings.HasPrefix(tag, "artist:") {
+			m.Artist = append(m.Artist, strings.TrimPrefix(tag, "artist:"))
+		}
+	}
+	return m
+}
+
+//embedFile puts metadata into image on disk. Files we don't know how to deal with stay as they are
+func embedFile(img Image, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := embedMeta(data, metaFor(img))
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, out, 0600); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, fi.Mode().Perm()); err != nil { //File stays with mode it had, whatever umask says
+		_ = os.Remove(tmp) //Nothing else to do with it
+		return err
+	}
+	return os.Rename(tmp, path) //Image stays whole until new one is ready
+}
+
+//embedMeta adds metadata to image, in the way its format allows
+func embedMeta(data []byte, m imageMeta) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPNG(data, m)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return embedJPEG(data, m)
+	case bytes.HasPrefix(data, []byte("GIF89a")):
+		return embedGIF(data, m)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return embedWebP(data, m)
+	}
+	return nil, errors.New("can't embed metadata into this format")
+}
+
+//stripMeta takes out whatever embedMeta put in. Anything else is left as it is
+func stripMeta(data []byte) []byte {
+	if !bytes.Contains(data, []byte(metaMarker)) && !bytes.Contains(data, iptcMarker) {
+		return data
+	}
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return stripPNG(data)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return stripJPEG(data)
+	case bytes.HasPrefix(data, []byte("GIF89a")):
+		return stripGIF(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return stripWebP(data)
+	}
+	return data
+}
+
+//xmpPacket is metadata as XMP, which all formats but IPTC take
+func xmpPacket(m imageMeta, addedContainer bool) []byte {
+	var b bytes.Buffer
+	esc := func(s string) string {
+		var e bytes.Buffer
+		_ = xml.EscapeText(&e, []byte(s)) //Writing into buffer doesn't fail
+		return e.String()
+	}
+	b.WriteString("<?xpacket begin=\"\xEF\xBB\xBF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\" xmlns:ponydownloader=\"" + metaMarker + "\">\n")
+	b.WriteString("   <dc:identifier>" + esc(m.URL) + "</dc:identifier>\n")
+	if m.Source != "" {
+		b.WriteString("   <dc:source>" + esc(m.Source) + "</dc:source>\n")
+	}
+	if len(m.Artist) != 0 {
+		b.WriteString("   <dc:creator><rdf:Seq>")
+		for _, a := range m.Artist {
+			b.WriteString("<rdf:li>" + esc(a) + "</rdf:li>")
+		}
+		b.WriteString("</rdf:Seq></dc:creator>\n")
+	}
+	if len(m.Tags) != 0 {
+		b.WriteString("   <dc:subject><rdf:Bag>")
+		for _, t := range m.Tags {
+			b.WriteString("<rdf:li>" + esc(t) + "</rdf:li>")
+		}
+		b.WriteString("</rdf:Bag></dc:subject>\n")
+	}
+	b.WriteString("   <ponydownloader:id>" + strconv.Itoa(m.ID) + "</ponydownloader:id>\n")
+	if addedContainer {
+		b.WriteString("   <ponydownloader:container>added</ponydownloader:container>\n")
+	}
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return b.Bytes()
+}
+
+//PNG: metadata goes into iTXt chunk in place of XMP that is there, or right after header
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+const xmpKeyword = "XML:com.adobe.xmp"
+
+func pngChunk(typ string, data []byte) []byte {
+	c := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	copy(c[4:], typ)
+	c = append(c, data...)
+	return append(c, make([]byte, 4)...)
+}
+
+func pngCRC(c []byte) {
+	binary.BigEndian.PutUint32(c[len(c)-4:], crc32.ChecksumIEEE(c[4:len(c)-4]))
+}
+
+//pngChunks splits PNG after signature into chunks, whole with length and CRC
+func pngChunks(data []byte) ([][]byte, error) {
+	var res [][]byte
+	for p := len(pngSignature); p < len(data); {
+		if len(data)-p < 12 {
+			return nil, errors.New("broken PNG")
+		}
+		n := int(binary.BigEndian.Uint32(data[p:]))
+		if n < 0 || len(data)-p-12 < n {
+			return nil, errors.New("broken PNG")
+		}
+		res = append(res, data[p:p+12+n])
+		p += 12 + n
+	}
+	return res, nil
+}
+
+//isXMPChunk tells if PNG chunk is iTXt with XMP, ours or not
+func isXMPChunk(c []byte) bool {
+	return string(c[4:8]) == "iTXt" && bytes.HasPrefix(c[8:], []byte(xmpKeyword+"\x00"))
+}
+
+//embedPNG puts our XMP in place of one picture already has, or right after header. XMP that was replaced is kept inside ours
+func embedPNG(data []byte, m imageMeta) ([]byte, error) {
+	chunks, err := pngChunks(stripPNG(data)) //Embedding again replaces what we embedded before, not what was there
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || string(chunks[0][4:8]) != "IHDR" {
+		return nil, errors.New("broken PNG")
+	}
+	at := -1
+	for i, c := range chunks {
+		if isXMPChunk(c) {
+			at = i
+			break
+		}
+	}
+
+	packet := xmpPacket(m, false)
+	if at >= 0 {
+		packet = keepReplaced(packet, "replacedXMP", chunks[at])
+	}
+	text := append([]byte(xmpKeyword+"\x00\x00\x00\x00\x00"), packet...) //Uncompressed, no language
+	c := pngChunk("iTXt", text)
+	pngCRC(c)
+
+	out := make([]byte, 0, len(data)+len(c))
+	out = append(out, pngSignature...)
+	for i, chunk := range chunks {
+		switch {
+		case i == at:
+			out = append(out, c...)
+		case i == 0 && at < 0:
+			out = append(append(out, chunk...), c...)
+		default:
+			out = append(out, chunk...)
+		}
+	}
+	return out, nil
+}
+
+func stripPNG(data []byte) []byte {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return data
+	}
+	out := append([]byte(nil), pngSignature...)
+	for _, c := range chunks {
+		if isXMPChunk(c) && bytes.Contains(c, []byte(metaMarker)) {
+			out = append(out, replacedSegment(c, "replacedXMP")...)
+			continue
+		}
+		out = append(out, c...)
+	}
+	return out
+}
+
+//JPEG: XMP goes into APP1 segment, IPTC into APP13, in place of ones that are there or right after JFIF and Exif ones
+
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+//iptcMarker is IPTC originating program dataset, which names us
+var iptcMarker = []byte("\x1c\x02\x41\x00\x0eponydownloader")
+
+//jpegSegments splits JPEG header, up to start of scan, into segments with their markers. Rest is image data
+func jpegSegments(data []byte) (segs [][]byte, rest []byte, err error) {
+	p := 2
+	for p < len(data) {
+		if data[p] != 0xFF {
+			return nil, nil, errors.New("broken JPEG")
+		}
+		if p+1 < len(data) && data[p+1] == 0xFF { //Fill byte
+			p++
+			continue
+		}
+		if len(data)-p < 4 {
+			return nil, nil, errors.New("broken JPEG")
+		}
+		marker := data[p+1]
+		if marker == 0xDA || marker == 0xD9 { //Start of scan or end of image, everything from here is kept as it is
+			return segs, data[p:], nil
+		}
+		n := int(binary.BigEndian.Uint16(data[p+2:]))
+		if n < 2 || len(data)-p-2 < n {
+			return nil, nil, errors.New("broken JPEG")
+		}
+		segs = append(segs, data[p:p+2+n])
+		p += 2 + n
+	}
+	return segs, nil, nil
+}
+
+func jpegSegment(marker byte, payload []byte) ([]byte, error) {
+	if len(payload) > 0xFFFF-2 {
+		return nil, errNoRoom
+	}
+	s := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(s[2:], uint16(len(payload)+2))
+	return append(s, payload...), nil
+}
+
+//truncUTF8 cuts string to at most n bytes, without cutting any letter in half
+func truncUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+//iptcRecords is metadata as IPTC datasets, with limits on length that IPTC sets
+func iptcRecords(m imageMeta) []byte {
+	var b bytes.Buffer
+	put := func(record, dataset byte, value string, max int) {
+		value = truncUTF8(value, max)
+		b.Write([]byte{0x1C, record, dataset, 0, 0})
+		binary.BigEndian.PutUint16(b.Bytes()[b.Len()-2:], uint16(len(value)))
+		b.WriteString(value)
+	}
+	put(1, 90, "\x1b%G", 32) //Everything is UTF-8
+	put(2, 65, "ponydownloader", 32)
+	for _, t := range m.Tags {
+		put(2, 25, t, 64)
+	}
+	for _, a := range m.Artist {
+		put(2, 80, a, 32)
+	}
+	caption := m.URL
+	if m.Source != "" {
+		caption += "\nSource: " + m.Source
+	}
+	put(2, 120, caption, 2000)
+	return b.Bytes()
+}
+
+func photoshopBlock(iptc []byte) []byte {
+	b := append([]byte(nil), photoshopHeader...)
+	b = append(b, "8BIM\x04\x04\x00\x00"...) //IPTC resource, without name
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(iptc)))
+	b = append(b, iptc...)
+	if len(iptc)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+//embedJPEG puts our XMP and IPTC in place of ones picture already has, so there is only one of each. Other Photoshop resources stay.
+//Segments that were replaced are kept inside our XMP, so stripJPEG could put them back
+func embedJPEG(data []byte, m imageMeta) ([]byte, error) {
+	segs, rest, err := jpegSegments(stripJPEG(data)) //Embedding again replaces what we embedded before, not what was there
+	if err != nil {
+		return nil, err
+	}
+	xi, pi := -1, -1
+	for i, s := range segs {
+		if xi < 0 && isXMPSegment(s) {
+			xi = i
+		}
+		if pi < 0 && isPhotoshopSegment(s) {
+			pi = i
+		}
+	}
+
+	packet := xmpPacket(m, false)
+	ps := photoshopBlock(iptcRecords(m))
+	if xi >= 0 {
+		packet = keepReplaced(packet, "replacedXMP", segs[xi])
+	}
+	if pi >= 0 {
+		packet = keepReplaced(packet, "replacedIPTC", segs[pi])
+		ps = photoshopMerge(segs[pi][4:], ps)
+	}
+	xmp, err := jpegSegment(0xE1, append(append([]byte(nil), xmpHeader...), packet...))
+	if err != nil {
+		return nil, err
+	}
+	iptc, err := jpegSegment(0xED, ps)
+	if err != nil {
+		return nil, err
+	}
+
+	var added []byte //What had no place of its own, goes right after JFIF and Exif, which want to be first
+	if xi < 0 {
+		added = append(added, xmp...)
+	}
+	if pi < 0 {
+		added = append(added, iptc...)
+	}
+	at := 0
+	for at < len(segs) && (segs[at][1] == 0xE0 || (segs[at][1] == 0xE1 && at != xi)) {
+		at++
+	}
+	out := make([]byte, 0, len(data)+len(xmp)+len(iptc))
+	out = append(out, 0xFF, 0xD8)
+	for i, s := range segs {
+		if i == at {
+			out = append(out, added...)
+		}
+		switch i {
+		case xi:
+			out = append(out, xmp...)
+		case pi:
+			out = append(out, iptc...)
+		default:
+			out = append(out, s...)
+		}
+	}
+	if at == len(segs) {
+		out = append(out, added...)
+	}
+	return append(out, rest...), nil
+}
+
+func isXMPSegment(s []byte) bool {
+	return s[1] == 0xE1 && bytes.HasPrefix(s[4:], xmpHeader)
+}
+
+func isPhotoshopSegment(s []byte) bool {
+	return s[1] == 0xED && bytes.HasPrefix(s[4:], photoshopHeader)
+}
+
+//keepReplaced puts segment or chunk we replace into our XMP packet, as base64 in element of its own
+func keepReplaced(packet []byte, name string, seg []byte) []byte {
+	at := bytes.LastIndex(packet, []byte("  </rdf:Description>"))
+	el := "   <ponydownloader:" + name + ">" + base64.StdEncoding.EncodeToString(seg) + "</ponydownloader:" + name + ">\n"
+	return append(append(append([]byte(nil), packet[:at]...), el...), packet[at:]...)
+}
+
+//replacedSegment is segment or chunk keepReplaced put into packet, nil if there is none
+func replacedSegment(packet []byte, name string) []byte {
+	open, end := []byte("<ponydownloader:"+name+">"), []byte("</ponydownloader:"+name+">")
+	i := bytes.Index(packet, open)
+	if i < 0 {
+		return nil
+	}
+	j := bytes.Index(packet[i:], end)
+	if j < 0 {
+		return nil
+	}
+	seg, err := base64.StdEncoding.DecodeString(string(packet[i+len(open) : i+j]))
+	if err != nil {
+		return nil
+	}
+	return seg
+}
+
+//photoshopMerge adds every resource of old Photoshop block, but IPTC one, to our block
+func photoshopMerge(old, ours []byte) []byte {
+	res := old[len(photoshopHeader):]
+	for len(res) >= 12 && string(res[:4]) == "8BIM" {
+		name := int(res[6]) + 1 //Pascal string, padded to even length
+		if name%2 != 0 {
+			name++
+		}
+		if len(res) < 6+name+4 {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(res[6+name:]))
+		n := 6 + name + 4 + size
+		if size < 0 || n > len(res) {
+			break
+		}
+		if size%2 != 0 && n < len(res) {
+			n++
+		}
+		if binary.BigEndian.Uint16(res[4:]) != 0x0404 {
+			ours = append(ours, res[:n]...)
+		}
+		res = res[n:]
+	}
+	return ours
+}
+
+func stripJPEG(data []byte) []byte {
+	segs, rest, err := jpegSegments(data)
+	if err != nil {
+		return data
+	}
+	var replacedXMP, replacedIPTC []byte
+	for _, s := range segs {
+		if isXMPSegment(s) && bytes.Contains(s, []byte(metaMarker)) {
+			replacedXMP, replacedIPTC = replacedSegment(s, "replacedXMP"), replacedSegment(s, "replacedIPTC")
+		}
+	}
+	out := []byte{0xFF, 0xD8}
+	for _, s := range segs {
+		switch {
+		case isXMPSegment(s) && bytes.Contains(s, []byte(metaMarker)):
+			out = append(out, replacedXMP...)
+			continue
+		case isPhotoshopSegment(s) && bytes.Contains(s, iptcMarker):
+			out = append(out, replacedIPTC...)
+			continue
+		}
+		out = append(out, s...)
+	}
+	return append(out, rest...)
+}
+
+//GIF: XMP goes into application extension right before trailer. Magic trailer after packet makes it valid data sub-blocks
+
+var gifXMPHeader = []byte("\x21\xff\x0bXMP DataXMP")
+
+func gifMagicTrailer() []byte {
+	t := []byte{0x01}
+	for i := 0xFF; i >= 0; i-- {
+		t = append(t, byte(i))
+	}
+	return append(t, 0x00)
+}
+
+func embedGIF(data []byte, m imageMeta) ([]byte, error) {
+	if data[len(data)-1] != 0x3B {
+		return nil, errors.New("broken GIF")
+	}
+	out := make([]byte, 0, len(data)+4096)
+	out = append(out, data[:len(data)-1]...)
+	out = append(out, gifXMPHeader...)
+	out = append(out, xmpPacket(m, false)...)
+	out = append(out, gifMagicTrailer()...)
+	return append(out, 0x3B), nil
+}
+
+func stripGIF(data []byte) []byte {
+	trailer := gifMagicTrailer()
+	at := bytes.LastIndex(data, gifXMPHeader)
+	if at < 0 || !bytes.HasSuffix(data, append(trailer, 0x3B)) || !bytes.Contains(data[at:], []byte(metaMarker)) {
+		return data
+	}
+	return append(append([]byte(nil), data[:at]...), 0x3B)
+}
+
+//WebP: XMP goes into its own chunk, which needs extended format. Simple files are made extended and then back
+
+const webpFlagXMP = 0x04
+
+type riffChunk struct {
+	fourcc string
+	data   []byte
+}
+
+func webpChunks(data []byte) ([]riffChunk, error) {
+	var res []riffChunk
+	for p := 12; p < len(data); {
+		if len(data)-p < 8 {
+			return nil, errors.New("broken WebP")
+		}
+		n := int(binary.LittleEndian.Uint32(data[p+4:]))
+		if n < 0 || len(data)-p-8 < n {
+			return nil, errors.New("broken WebP")
+		}
+		res = append(res, riffChunk{string(data[p : p+4]), data[p+8 : p+8+n]})
+		p += 8 + n + n%2
+	}
+	return res, nil
+}
+
+func webpWrite(chunks []riffChunk) []byte {
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		out = append(out, c.fourcc...)
+		out = append(out, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(len(c.data)))
+		out = append(out, c.data...)
+		if len(c.data)%2 != 0 {
+			out = append(out, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+//webpCanvas gets size of simple WebP image from its bitstream. Alpha flag is not set for lossless ones,
+//they carry alpha on their own and some decoders take the flag as promise of separate alpha chunk
+func webpCanvas(c riffChunk) (w, h int, err error) {
+	switch c.fourcc {
+	case "VP8L":
+		if len(c.data) < 5 || c.data[0] != 0x2F {
+			break
+		}
+		v := binary.LittleEndian.Uint32(c.data[1:])
+		return int(v&0x3FFF) + 1, int(v>>14&0x3FFF) + 1, nil
+	case "VP8 ":
+		if len(c.data) < 10 || !bytes.Equal(c.data[3:6], []byte{0x9D, 0x01, 0x2A}) {
+			break
+		}
+		return int(binary.LittleEndian.Uint16(c.data[6:]) & 0x3FFF), int(binary.LittleEndian.Uint16(c.data[8:]) & 0x3FFF), nil
+	}
+	return 0, 0, errors.New("broken WebP")
+}
+
+func embedWebP(data []byte, m imageMeta) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("broken WebP")
+	}
+
+	added := false
+	if chunks[0].fourcc == "VP8X" {
+		if len(chunks[0].data) < 10 {
+			return nil, errors.New("broken WebP")
+		}
+		if chunks[0].data[0]&webpFlagXMP != 0 {
+			return nil, errNoRoom //Has XMP of its own already
+		}
+		x := append([]byte(nil), chunks[0].data...)
+		x[0] |= webpFlagXMP
+		chunks[0].data = x
+	} else {
+		w, h, err := webpCanvas(chunks[0])
+		if err != nil {
+			return nil, err
+		}
+		x := make([]byte, 10)
+		x[0] = webpFlagXMP
+		x[4], x[5], x[6] = byte(w-1), byte((w-1)>>8), byte((w-1)>>16)
+		x[7], x[8], x[9] = byte(h-1), byte((h-1)>>8), byte((h-1)>>16)
+		chunks = append([]riffChunk{{"VP8X", x}}, chunks...)
+		added = true
+	}
+	chunks = append(chunks, riffChunk{"XMP ", xmpPacket(m, added)})
+	return webpWrite(chunks), nil
+}
+
+func stripWebP(data []byte) []byte {
+	chunks, err := webpChunks(data)
+	if err != nil || len(chunks) == 0 || chunks[0].fourcc != "VP8X" {
+		return data
+	}
+	var out []riffChunk
+	found, added := false, false
+	for _, c := range chunks {
+		if c.fourcc == "XMP " && bytes.Contains(c.data, []byte(metaMarker)) {
+			found = true
+			added = bytes.Contains(c.data, []byte("<ponydownloader:container>added<"))
+			continue
+		}
+		out = append(out, c)
+	}
+	if !found {
+		return data
+	}
+	if added {
+		out = out[1:]
+	} else {
+		x := append([]byte(nil), out[0].data...)
+		x[0] &^= webpFlagXMP
+		out[0].data = x
+	}
+	return webpWrite(out)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//tinyWebP is 1x1 lossless WebP
+const tinyWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func TestEmbedMeta(t *testing.T) {
+	pic := testPicture(64, 48, false)
+	var p, j, g bytes.Buffer
+	_ = png.Encode(&p, pic)
+	_ = jpeg.Encode(&j, pic, nil)
+	_ = gif.Encode(&g, pic, nil)
+	w, _ := base64.StdEncoding.DecodeString(tinyWebP)
+
+	img := Image{Imgid: 1605729, Tags: "safe, artist:somepony, princess luna, <&>", Source: "https://example.com/luna?a=1&b=2"}
+	m := metaFor(img)
+	if len(m.Artist) != 1 || m.Artist[0] != "somepony" || len(m.Tags) != 4 || m.URL != "https://derpibooru.org/1605729" {
+		t.Fatalf("Wrong metadata: %+v", m)
+	}
+
+	for name, orig := range map[string][]byte{"png": p.Bytes(), "jpeg": j.Bytes(), "gif": g.Bytes(), "webp": w} {
+		out, err := embedMeta(orig, m)
+		if err != nil {
+			t.Error(name, ": ", err)
+			continue
+		}
+		if !bytes.Contains(out, []byte("<rdf:li>princess luna</rdf:li>")) || !bytes.Contains(out, []byte("&lt;&amp;&gt;")) {
+			t.Error(name, ": tags are not embedded")
+		}
+		if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+			t.Error(name, ": image is broken by metadata: ", err)
+		}
+		if !bytes.Equal(stripMeta(out), orig) {
+			t.Error(name, ": original is not given back")
+		}
+	}
+
+	if out := mustEmbed(t, j.Bytes(), m); !bytes.Contains(out, []byte("\x1c\x02\x50\x00\x08somepony")) || !bytes.Contains(out, iptcMarker) {
+		t.Error("Artist is not in IPTC")
+	}
+	if !bytes.Equal(stripMeta(p.Bytes()), p.Bytes()) {
+		t.Error("Image without metadata is changed")
+	}
+}
+
+func TestEmbedJPEGReplacesSegments(t *testing.T) {
+	var j bytes.Buffer
+	_ = jpeg.Encode(&j, testPicture(64, 48, false), nil)
+	xmp, _ := jpegSegment(0xE1, append(append([]byte(nil), xmpHeader...), "<x:xmpmeta>theirs</x:xmpmeta>"...))
+	ps, _ := jpegSegment(0xED, append(photoshopBlock([]byte("\x1c\x02\x19\x00\x05other")), "8BIM\x03\xed\x00\x00\x00\x00\x00\x02ok"...))
+	orig := append(append(append([]byte{0xFF, 0xD8}, xmp...), ps...), j.Bytes()[2:]...)
+
+	m := metaFor(Image{Imgid: 1, Tags: "safe"})
+	out := mustEmbed(t, orig, m)
+	segs, _, err := jpegSegments(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xmps, pss int
+	for _, s := range segs {
+		if isXMPSegment(s) {
+			xmps++
+		}
+		if isPhotoshopSegment(s) {
+			pss++
+			if bytes.Contains(s, []byte("other")) || !bytes.Contains(s, []byte("\x03\xed")) {
+				t.Error("IPTC is not replaced, or other resources are lost")
+			}
+		}
+	}
+	if xmps != 1 || pss != 1 {
+		t.Errorf("Expected one XMP and one IPTC segment, got %d and %d", xmps, pss)
+	}
+	if !bytes.Equal(stripMeta(out), orig) {
+		t.Error("Original is not given back")
+	}
+	if again := mustEmbed(t, out, m); !bytes.Equal(again, out) {
+		t.Error("Embedding again changes file")
+	}
+}
+
+func TestEmbedPNGReplacesXMP(t *testing.T) {
+	var p bytes.Buffer
+	_ = png.Encode(&p, testPicture(64, 48, false))
+	chunks, err := pngChunks(p.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs := pngChunk("iTXt", []byte(xmpKeyword+"\x00\x00\x00\x00\x00<x:xmpmeta>theirs</x:xmpmeta>"))
+	pngCRC(theirs)
+	orig := append(append(append([]byte(nil), pngSignature...), chunks[0]...), theirs...)
+	orig = append(orig, p.Bytes()[len(pngSignature)+len(chunks[0]):]...)
+
+	m := metaFor(Image{Imgid: 1, Tags: "safe"})
+	out := mustEmbed(t, orig, m)
+	if chunks, err = pngChunks(out); err != nil {
+		t.Fatal(err)
+	}
+	xmps := 0
+	for _, c := range chunks {
+		if isXMPChunk(c) {
+			xmps++
+		}
+	}
+	if xmps != 1 {
+		t.Errorf("Expected one XMP chunk, got %d", xmps)
+	}
+	if _, err = png.Decode(bytes.NewReader(out)); err != nil {
+		t.Error("Image is broken by metadata: ", err)
+	}
+	if !bytes.Equal(stripMeta(out), orig) {
+		t.Error("Original is not given back")
+	}
+	if again := mustEmbed(t, out, m); !bytes.Equal(again, out) {
+		t.Error("Embedding again changes file")
+	}
+}
+
+func TestEmbedKeepsHash(t *testing.T) {
+	var p bytes.Buffer
+	_ = png.Encode(&p, testPicture(64, 48, false))
+	path := filepath.Join(t.TempDir(), "1.png")
+	if err := ioutil.WriteFile(path, p.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chmod(path, 0644)
+	before, _ := hashFile(path)
+	if err := embedFile(Image{Imgid: 1, Tags: "safe"}, path); err != nil {
+		t.Fatal(err)
+	}
+	after, err := hashFile(path)
+	if err != nil || after != before || getFileSize(path) == int64(p.Len()) {
+		t.Error("Hash of original is lost: ", before, after, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0644 {
+		t.Error("Mode of file is lost: ", fi, err)
+	}
+}
+
+func mustEmbed(t *testing.T, data []byte, m imageMeta) []byte {
+	out, err := embedMeta(data, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestTruncUTF8(t *testing.T) {
+	if s := truncUTF8("принцесса", 5); s != "пр" {
+		t.Error("Cut wrong: ", s)
+	}
+}
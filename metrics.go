@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//metrics counts what happens during the run, for Prometheus to scrape. It is always there, counting is cheap
+var metrics = newMetricSet()
+
+//latencyBuckets are upper bounds of request latency histogram, in seconds. Same as Prometheus client uses by default
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//histogram counts observations into cumulative buckets, as Prometheus expects them
+type histogram struct {
+	counts []uint64 //One per bucket, not cumulative, cumulated when written
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+//requestKey is what requests are told apart by: whether they went to API or for image, and how server answered
+type requestKey struct {
+	kind string
+	code string
+}
+
+type metricSet struct {
+	mu       sync.Mutex
+	images   map[outcome]uint64
+	bytes    uint64
+	requests map[requestKey]uint64
+	latency  map[string]*histogram
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		images:   map[outcome]uint64{outcomeDownloaded: 0, outcomeSkipped: 0, outcomeFiltered: 0, outcomeFailed: 0},
+		requests: make(map[requestKey]uint64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+//requestKind tells API requests from image downloads. Everything API gives is JSON
+func requestKind(req *http.Request) string {
+	if req != nil && req.URL != nil && (strings.HasSuffix(req.URL.Path, ".json") || strings.HasPrefix(req.URL.Path, "/api/")) {
+		return "api"
+	}
+	return "image"
+}
+
+//image notes what happened to single image
+func (m *metricSet) image(o outcome) {
+	m.mu.Lock()
+	m.images[o]++
+	m.mu.Unlock()
+}
+
+//transferred notes bytes got from server
+func (m *metricSet) transferred(n int64) {
+	if n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	m.bytes += uint64(n)
+	m.mu.Unlock()
+}
+
+//requested notes how long request took until server answered. Requests that got no answer at all are noted too
+func (m *metricSet) requested(req *http.Request, took time.Duration, err error) {
+	kind := requestKind(req)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.requests[requestKey{kind, "error"}]++
+		return
+	}
+	h, ok := m.latency[kind]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[kind] = h
+	}
+	h.observe(took.Seconds())
+}
+
+//status notes how server answered
+func (m *metricSet) status(resp *http.Response) {
+	m.mu.Lock()
+	m.requests[requestKey{requestKind(resp.Request), strconv.Itoa(resp.StatusCode)}]++
+	m.mu.Unlock()
+}
+
+//ServeHTTP writes all metrics in Prometheus text format
+func (m *metricSet) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *metricSet) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ponydownloader_images_total Images done with, by what happened to them.")
+	fmt.Fprintln(w, "# TYPE ponydownloader_images_total counter")
+	outcomes := make([]string, 0, len(m.images))
+	for o := range m.images {
+		outcomes = append(outcomes, string(o))
+	}
+	sort.Strings(outcomes)
+	for _, o := range outcomes {
+		fmt.Fprintf(w, "ponydownloader_images_total{outcome=%q} %d\n", o, m.images[outcome(o)])
+	}
+
+	fmt.Fprintln(w, "# HELP ponydownloader_bytes_total Bytes of images got from server.")
+	fmt.Fprintln(w, "# TYPE ponydownloader_bytes_total counter")
+	fmt.Fprintf(w, "ponydownloader_bytes_total %d\n", m.bytes)
+
+	fmt.Fprintln(w, "# HELP ponydownloader_requests_total Requests to server, by kind and status code.")
+	fmt.Fprintln(w, "# TYPE ponydownloader_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].kind != keys[b].kind {
+			return keys[a].kind < keys[b].kind
+		}
+		return keys[a].code < keys[b].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "ponydownloader_requests_total{kind=%q,code=%q} %d\n", k.kind, k.code, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP ponydownloader_request_duration_seconds Time until server answered request, by kind.")
+	fmt.Fprintln(w, "# TYPE ponydownloader_request_duration_seconds histogram")
+	kinds := make([]string, 0, len(m.latency))
+	for kind := range m.latency {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		h := m.latency[kind]
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "ponydownloader_request_duration_seconds_bucket{kind=%q,le=%q} %d\n", kind, strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "ponydownloader_request_duration_seconds_bucket{kind=%q,le=\"+Inf\"} %d\n", kind, h.count)
+		fmt.Fprintf(w, "ponydownloader_request_duration_seconds_sum{kind=%q} %g\n", kind, h.sum)
+		fmt.Fprintf(w, "ponydownloader_request_duration_seconds_count{kind=%q} %d\n", kind, h.count)
+	}
+}
+
+//serveMetrics starts serving metrics on given address in background. Listening starts right away, so wrong address is noticed
+func serveMetrics(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			lErr("Metrics server stopped: ", err)
+		}
+	}()
+	lInfo("Serving metrics at", "http://"+ln.Addr().String()+"/metrics")
+	return srv, nil
+}
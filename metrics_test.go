@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	saved := metrics
+	metrics = newMetricSet()
+	defer func() { metrics = saved }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search.json":
+			_, _ = w.Write([]byte(`{"search":[],"total":0}`))
+		case "/1.png":
+			_, _ = w.Write([]byte("not really a png"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	if _, err := getJSON(context.Background(), ts.URL+"/search.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getJSON(context.Background(), ts.URL+"/images/1.json"); err == nil {
+		t.Error("Missing page reported as fine")
+	}
+	u, _ := url.Parse(ts.URL + "/1.png")
+	img := Image{Imgid: 1, URL: u, Filename: "1.png"}
+	size, err := img.saveImage(context.Background(), newDirStorage(t.TempDir()), nil)
+	newRunReport().downloaded(img, size, err)
+	newRunReport().add(Image{Imgid: 2}, outcomeFiltered, 0, nil)
+
+	scrape := httptest.NewServer(metrics)
+	defer scrape.Close()
+	resp, err := http.Get(scrape.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	got := string(body)
+
+	for _, line := range []string{
+		`ponydownloader_images_total{outcome="downloaded"} 1`,
+		`ponydownloader_images_total{outcome="filtered"} 1`,
+		`ponydownloader_images_total{outcome="failed"} 0`,
+		`ponydownloader_bytes_total 16`,
+		`ponydownloader_requests_total{kind="api",code="200"} 1`,
+		`ponydownloader_requests_total{kind="api",code="404"} 1`,
+		`ponydownloader_requests_total{kind="image",code="200"} 1`,
+		`ponydownloader_request_duration_seconds_bucket{kind="api",le="+Inf"} 2`,
+		`ponydownloader_request_duration_seconds_count{kind="image"} 1`,
+		"# TYPE ponydownloader_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Missing %s in:\n%s", line, got)
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := &histogram{counts: make([]uint64, len(latencyBuckets))}
+	h.observe(0.001)
+	h.observe(0.3)
+	h.observe(100)
+	if h.counts[0] != 1 || h.counts[6] != 1 || h.count != 3 {
+		t.Errorf("Observations went into wrong buckets: %v", h.counts)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//manifestName is list of files at the end of archive, one JSON per line
+const manifestName = "manifest.jsonl"
+
+//manifestEntry is single file in archive, as noted in manifest
+type manifestEntry struct {
+	ID     int    `json:"id,omitempty"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Orig   string `json:"orig_sha256,omitempty"` //Of file as it came from server, before metadata was embedded
+}
+
+//packWriter puts files into archive one after another
+type packWriter interface {
+	add(name string, size int64, r io.Reader) error
+	close() error
+}
+
+//packStorage streams images into single archive. Workers download into temporary files,
+//and files are put into archive whole, one at a time
+type packStorage struct {
+	mu       sync.Mutex
+	out      io.WriteCloser
+	w        packWriter
+	sizes    map[string]int64
+	manifest []manifestEntry
+	withList bool
+}
+
+func newPackStorage(out io.WriteCloser, format string, withManifest bool) (*packStorage, error) {
+	s := &packStorage{out: out, sizes: make(map[string]int64), withList: withManifest}
+	switch format {
+	case "zip":
+		s.w = &zipPack{zip.NewWriter(out)}
+	case "tar":
+		s.w = &tarPack{tw: tar.NewWriter(out)}
+	case "tar.zst":
+		zw, err := zstd.NewWriter(out)
+		if err != nil {
+			return nil, err
+		}
+		s.w = &tarPack{tw: tar.NewWriter(zw), under: zw}
+	default:
+		return nil, fmt.Errorf("unknown archive format %s", format)
+	}
+	return s, nil
+}
+
+//Exists knows only about files put into archive in this run, archive is new every time
+func (s *packStorage) Exists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.sizes[name]
+	return ok
+}
+
+func (s *packStorage) Size(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizes[name]
+}
+
+func (s *packStorage) Hash(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.manifest {
+		if e.File == name && e.Orig != "" {
+			return e.Orig, nil
+		}
+		if e.File == name {
+			return e.SHA256, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func (s *packStorage) Create(name string) (Upload, error) {
+	return newTempUpload(name, func(path string, size int64, hash string) error { return s.put(name, path, size, hash) })
+}
+
+//Remove can't take back what was streamed already
+func (s *packStorage) Remove(name string) error {
+	return errCantRemove
+}
+
+//put copies file into archive. Size and hash are of file as it came from server
+func (s *packStorage) put(name, path string, size int64, hash string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //Read-only, nothing to lose
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := sha256.New()
+	if err = s.w.add(name, fi.Size(), io.TeeReader(in, h)); err != nil {
+		return err
+	}
+	s.sizes[name] = size
+	e := manifestEntry{ID: fileID(name), File: name, Size: fi.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}
+	if e.SHA256 != hash {
+		e.Orig = hash
+	}
+	s.manifest = append(s.manifest, e)
+	return nil
+}
+
+//Close writes manifest, if asked to, and finishes archive
+func (s *packStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.withList {
+		var list []byte
+		for _, e := range s.manifest {
+			line, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			list = append(append(list, line...), '\n')
+		}
+		if err := s.w.add(manifestName, int64(len(list)), bytes.NewReader(list)); err != nil {
+			return err
+		}
+	}
+	if err := s.w.close(); err != nil {
+		_ = s.out.Close() //First error is more interesting
+		return err
+	}
+	if s.out == os.Stdout {
+		return nil
+	}
+	return s.out.Close()
+}
+
+type zipPack struct {
+	zw *zip.Writer
+}
+
+func (p *zipPack) add(name string, size int64, r io.Reader) error {
+	w, err := p.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()}) //Images are compressed already
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (p *zipPack) close() error {
+	return p.zw.Close()
+}
+
+type tarPack struct {
+	tw    *tar.Writer
+	under io.WriteCloser //Compressor under tar, if there is one
+}
+
+func (p *tarPack) add(name string, size int64, r io.Reader) error {
+	err := p.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(p.tw, r)
+	return err
+}
+
+func (p *tarPack) close() error {
+	if err := p.tw.Close(); err != nil {
+		return err
+	}
+	if p.under != nil {
+		return p.under.Close()
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//readPack gets all files from archive, by name
+func readPack(t *testing.T, format string, data []byte) map[string]string {
+	files := make(map[string]string)
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			r, _ := f.Open()
+			content, _ := ioutil.ReadAll(r)
+			files[f.Name] = string(content)
+		}
+		return files
+	}
+
+	var in io.Reader = bytes.NewReader(data)
+	if format == "tar.zst" {
+		zr, err := zstd.NewReader(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		in = zr
+	}
+	tr := tar.NewReader(in)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		files[h.Name] = string(content)
+	}
+}
+
+func TestPackStorage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/3.png" {
+			w.Header().Set("Content-Length", "100") //Promising more than there is
+		}
+		_, _ = w.Write([]byte("pony " + r.URL.Path))
+	}))
+	defer ts.Close()
+
+	for _, format := range []string{"zip", "tar", "tar.zst"} {
+		var out bytes.Buffer
+		store, err := newPackStorage(nopCloser{&out}, format, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"1.png", "2.gif", "3.png", "1.png"} {
+			u, _ := url.Parse(ts.URL + "/" + name)
+			_, _ = Image{Imgid: fileID(name), URL: u, Filename: name}.saveImage(context.Background(), store, nil)
+		}
+		if err = store.Close(); err != nil {
+			t.Fatal(format, ": ", err)
+		}
+
+		files := readPack(t, format, out.Bytes())
+		if len(files) != 3 || files["1.png"] != "pony /1.png" || files["2.gif"] != "pony /2.gif" {
+			t.Errorf("%s: wrong files in archive: %v", format, files)
+		}
+		lines := strings.Split(strings.TrimSpace(files[manifestName]), "\n")
+		var e manifestEntry
+		if err = json.Unmarshal([]byte(lines[0]), &e); err != nil || len(lines) != 2 || e.ID != 1 || e.Size != 11 || len(e.SHA256) != 64 {
+			t.Errorf("%s: wrong manifest: %v, %v", format, lines, err)
+		}
+	}
+}
+
+func TestPackFormat(t *testing.T) {
+	for name, format := range map[string]string{"pack.zip": "zip", "pack.tar": "tar", "pack.tar.zst": "tar.zst", "-": "tar", "pack.rar": ""} {
+		if got := packFormat(name); got != format {
+			t.Errorf("%s: expected %q, got %q", name, format, got)
+		}
+	}
+}
@@ -1,45 +1,83 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 	//	"github.com/davecgh/go-spew/spew"
 )
 
-var (
-	derpiURL = url.URL{
-		Scheme: "https",
-		Host:   "derpibooru.org",
+//derpiURL is where Derpibooru is. It is not changed once we run, workers read it all the time: addresses are built with apiURL
+var derpiURL = url.URL{
+	Scheme: "https",
+	Host:   "derpibooru.org",
+}
+
+//apiURL is address of path on server at base, with query. Key goes there too, if there is one
+func apiURL(base url.URL, path string, q url.Values, key string) string {
+	if key != "" {
+		q.Set("key", key)
 	}
-	derpiquery = make(url.Values)
-)
+	base.Path = path
+	base.RawQuery = q.Encode()
+	return base.String()
+}
 
 //RawImage contains data we got from API that needs to be modified before further usage
 type RawImage struct {
-	Imgid          int    `json:"id"`
-	URL            string `json:"image"`
-	Score          int    `json:"score"`
-	OriginalFormat string `json:"original_format"`
-	Faves          int    `json:"faves"`
+	Imgid          int       `json:"id"`
+	URL            string    `json:"image"`
+	Score          int       `json:"score"`
+	OriginalFormat string    `json:"original_format"`
+	Faves          int       `json:"faves"`
+	Width          int       `json:"width"`
+	Height         int       `json:"height"`
+	Size           int64     `json:"size"`
+	CreatedAt      time.Time `json:"created_at"`
+	Tags           string    `json:"tags"` //Comma separated
+	SourceURL      string    `json:"source_url"`
+	Description    string    `json:"description"`
+
+	Representations map[string]string `json:"representations"`
 }
 
 //Image contains data needed to filter fetch and save image
 type Image struct {
-	Imgid    int
-	URL      *url.URL
-	Filename string
-	Score    int
-	Faves    int
+	Imgid       int
+	URL         *url.URL
+	Filename    string
+	Score       int
+	Faves       int
+	Width       int
+	Height      int
+	Size        int64
+	Created     time.Time
+	Format      string   //Original format of image, even when we are saving some alternate of it
+	Thumb       *url.URL //Small render, to look at image before downloading it
+	Tags        string   //Comma separated, as API gives them
+	Source      string   //Where image came from, as uploader said
+	Description string   //As uploader wrote it
 }
 
 //Search returns to us array of searched images...
 type Search struct {
 	Images []RawImage `json:"search"`
+	Total  int        `json:"total"`
 }
 
+//maxWindowImages is how many images single search may hold before it gets sliced into time windows.
+//Derpibooru doesn't let pagination go too deep, so walking big tag page by page dies midway
+const maxWindowImages = 10000
+
+//derpiEpoch is earlier than any image on Derpibooru
+var derpiEpoch = time.Date(2012, time.January, 1, 0, 0, 0, 0, time.UTC)
+
 //Push gets unmarchalled JSON info, massages it and plugs it into channel so it
 //would be processed in other places
 func trim(dat RawImage) Image {
@@ -49,35 +87,61 @@ func trim(dat RawImage) Image {
 	tu.Scheme = derpiURL.Scheme
 	tu.Path = path.Dir(tu.Path) + "/" + fn
 
-	return Image{
-		Imgid:    dat.Imgid,
-		Filename: fn,
-		URL:      tu,
-		Score:    dat.Score,
-		Faves:    dat.Faves,
+	img := Image{
+		Imgid:       dat.Imgid,
+		Filename:    fn,
+		URL:         tu,
+		Score:       dat.Score,
+		Faves:       dat.Faves,
+		Width:       dat.Width,
+		Height:      dat.Height,
+		Size:        dat.Size,
+		Created:     dat.CreatedAt,
+		Format:      dat.OriginalFormat,
+		Thumb:       thumbURL(dat),
+		Tags:        dat.Tags,
+		Source:      dat.SourceURL,
+		Description: dat.Description,
 	}
+
+	if !isResized() {
+		return img
+	}
+
+	//Smaller sizes are renders server made for us. Size goes into filename, so every size is its own file
+	rep, err := url.Parse(dat.Representations[mediaOpts.Size])
+	if err != nil || rep.Path == "" {
+		lWarn("No", mediaOpts.Size, "size for image", dat.Imgid, "saving original instead")
+		return img
+	}
+	rep.Scheme = derpiURL.Scheme
+	img.URL = rep
+	img.Filename = strconv.Itoa(dat.Imgid) + "_" + mediaOpts.Size + path.Ext(rep.Path)
+	img.Size = 0 //API knows size only of original
+	return img
+}
+
+//isResized tells if we are after some representation instead of original
+func isResized() bool {
+	return mediaOpts.Size != "" && mediaOpts.Size != "full"
 }
 
 //ParseImg gets image IDs, fetches information about those images from Derpibooru and pushes them into the channel.
-func ParseImg(imgchan chan<- Image, ids []int, key string) {
+func ParseImg(ctx context.Context, imgchan chan<- Image, ids []int, key string) {
+
+	progress.addTotal(len(ids))
 
 	for _, imgid := range ids {
 
-		if isInterrupted() {
+		if ctx.Err() != nil {
 			break
 		}
 
-		derpiURL.Path = strconv.Itoa(imgid) + ".json"
-		derpiURL.RawQuery = ""
-
-		lInfo("Getting image info at:", derpiURL.String())
-		if key != "" {
-			derpiquery.Add("key", key)
-		}
-		derpiURL.RawQuery = derpiquery.Encode()
-		body, err := getJSON(derpiURL.String())
+		lDetail("Getting image info at:", apiURL(derpiURL, strconv.Itoa(imgid)+".json", url.Values{}, ""))
+		body, err := getJSON(ctx, apiURL(derpiURL, strconv.Itoa(imgid)+".json", url.Values{}, key))
 		if err != nil {
 			lErr(err)
+			report.apiError(err)
 			break
 		}
 		var dat RawImage
@@ -85,98 +149,240 @@ func ParseImg(imgchan chan<- Image, ids []int, key string) {
 
 		err != nil {
 			lErr(err)
+			report.apiError(err)
 			continue
 		}
 
-		imgchan <- trim(dat)
+		for _, img := range variants(dat) {
+			if !send(ctx, imgchan, img) {
+				break
+			}
+		}
 	}
 
 	close(imgchan) //closing channel, we are done here
 }
 
-//DlImg reads image data from channel and downloads specified images to disc
-func downloadImages(imgchan <-chan Image, opts *Config) {
+//imageInfo gets what Derpibooru knows about single image
+func imageInfo(ctx context.Context, id int, key string) (dat RawImage, err error) {
+	body, err := getJSON(ctx, apiURL(derpiURL, strconv.Itoa(id)+".json", url.Values{}, key))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &dat)
+	return
+}
+
+//workers is how many images are downloaded at once
+const workers = 4
+
+//DlImg reads image data from channel and downloads specified images to disc. Cancelling context aborts downloads in progress
+func downloadImages(ctx context.Context, imgchan <-chan Image, store Storage) {
 
 	lInfo("Worker started; reading channel") //nice notification that we are not forgotten
 	var n int
 	var size int64
 	var l sync.Mutex
 	var wg sync.WaitGroup
-	for k := 0; k < 4; k++ {
+	for k := 0; k < workers; k++ {
 		wg.Add(1)
-		go func() {
+		go func(bar *workerBar) {
 			for imgdata := range imgchan {
 
-				lInfo("Saving as", imgdata.Filename)
+				lDetailw("Saving as "+imgdata.Filename, logFields{"image_id": imgdata.Imgid, "file": imgdata.Filename})
 
-				tsize, ok := imgdata.saveImage(opts)
+				tsize, err := imgdata.saveImage(ctx, store, bar)
+				report.downloaded(imgdata, tsize, err)
+				if err == nil {
+					hooks.completed(imgdata, tsize) //Only for images that are new, or hooks would be run on whole collection every time
+				}
+				if err == nil || err == errNoClobber {
+					thumbnailer.add(imgdata.Filename)
+					threads.saved(imgdata, err == nil)
+				}
 				l.Lock()
 				size += tsize
-				if ok {
+				if err == nil {
 					n++
 				}
 				l.Unlock()
 			}
 			wg.Done()
-		}()
+		}(progress.bar(k))
 	}
 	wg.Wait()
 	lInfof("Downloaded %d images, for a total of %s", n, fmtbytes(float64(size)))
 }
 
 //ParseTag gets image tags, fetches information about all images it could from Derpibooru and pushes them into the channel.
-func ParseTag(imgchan chan<- Image, opts *TagOpts, key string) {
+//Date limits of filters are sent to server, so it would do the filtering for us
+func ParseTag(ctx context.Context, imgchan chan<- Image, opts *TagOpts, filt *FiltOpts, key string) {
 
-	//Unlike main, I don't see how I could separate bits out to decrease complexity
-	derpiURL.Path = "search.json"
-	derpiquery.Add("sbq", opts.Tag)
-	derpiURL.RawQuery = derpiquery.Encode()
-	lInfo("Searching as", derpiURL.String())
+	defer close(imgchan)
 
-	if key != "" {
-		derpiquery.Add("key", key)
+	whole := window{since: filt.Since.Time}
+	if !filt.Until.IsZero() {
+		whole.before = filt.Until.before()
+	}
+	windows := []window{whole}
+	startPage := opts.StartPage
+
+	//Explicit pages are pages of the whole search, slicing it would make them meaningless
+	sliced := opts.StartPage <= 1 && opts.StopPage == 0
+
+	if st := opts.resume; st != nil {
+		//Continuing window we stopped in, then whatever is older than it
+		lInfo("Resuming search from page", st.Page)
+		windows = []window{{since: st.Since, before: st.Before}}
+		startPage = st.Page
+		if sliced && !st.Since.IsZero() && st.Since.After(whole.since) {
+			windows = append(windows, splitWindow(ctx, opts.Tag, key, window{since: whole.since, before: st.Since})...)
+		}
+	} else if sliced {
+		windows = splitWindow(ctx, opts.Tag, key, whole)
 	}
 
-	for page := opts.StartPage; opts.StopPage == 0 || page <= opts.StopPage; page++ {
-
-		if isInterrupted() {
-			break
+	sent := make(map[int]bool) //New uploads push images we already got onto next page
+	for i, w := range windows {
+		if i != 0 {
+			startPage = opts.StartPage
 		}
+		if !searchPages(ctx, imgchan, opts.Tag, key, w, startPage, opts.StopPage, sent) {
+			return
+		}
+	}
+	checkpoint.finishedSearch()
+}
 
-		lInfo("Searching page", page)
-		derpiquery.Set("page", strconv.Itoa(page))
-		derpiURL.RawQuery = derpiquery.Encode()
+//searchPages walks over pages of a single search. Images in sent were already sent in this run, ones it sends are added there.
+//Returns false if walk was cut short and nothing else should be searched
+func searchPages(ctx context.Context, imgchan chan<- Image, tag, key string, w window, startPage, stopPage int, sent map[int]bool) bool {
 
-		body, err := getJSON(derpiURL.String())
-		if err != nil {
-			lErr("Error while getting json from page ", page)
-			lErr(err)
-			break
-		}
+	query := w.query(tag)
+	lInfo("Searching as", apiURL(derpiURL, "search.json", url.Values{"sbq": {query}}, "")) //Not showing key in logs
 
-		var dats Search
-		err = json.Unmarshal(body, &dats)
+	for page := startPage; stopPage == 0 || page <= stopPage; page++ {
 
-		if err != nil {
-			lErr("Error while parsing search page", page)
-			lErr(err)
-			if serr, ok := err.(*json.SyntaxError); ok { //In case crap was still given, we are looking at it.
-				lErr("Occurred at offset: ", serr.Offset)
-			}
-			break
+		if ctx.Err() != nil {
+			return false
+		}
 
+		lInfow(fmt.Sprint("Searching page ", page), logFields{"page": page})
+		dats, err := searchPage(ctx, query, key, page)
+		if err != nil {
+			return false
 		}
 
 		if len(dats.Images) == 0 {
 			lInfo("Pages are all over") //Does not mean that process is over.
-			break
+			return true
 		} //exit due to finishing all pages
 
+		if page == startPage {
+			progress.addTotal(expectedImages(dats.Total, len(dats.Images), startPage, stopPage))
+		}
+
+		var imgs []Image
 		for _, dat := range dats.Images {
-			imgchan <- trim(dat)
+			if sent[dat.Imgid] || checkpoint.seen(dat.Imgid) { //Pushed to this page by new uploads, or got here before resuming
+				continue
+			}
+			sent[dat.Imgid] = true
+			imgs = append(imgs, variants(dat)...)
+		}
+		checkpoint.fetched(w, page, imgs)
+
+		for _, img := range imgs {
+			if !send(ctx, imgchan, img) {
+				return false
+			}
+		}
+
+	}
+	return true
+}
+
+//expectedImages guesses how many images we would get from pages of search, judging by the first page we got
+func expectedImages(total, perPage, startPage, stopPage int) int {
+	n := total - (startPage-1)*perPage
+	if stopPage != 0 && (stopPage-startPage+1)*perPage < n {
+		n = (stopPage - startPage + 1) * perPage
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+//searchPage fetches and parses one page of search for query
+func searchPage(ctx context.Context, query, key string, page int) (dats Search, err error) {
+	q := url.Values{"sbq": {query}, "page": {strconv.Itoa(page)}, "sf": {searchField}, "sd": {searchDirection}}
+	body, err := getJSON(ctx, apiURL(derpiURL, "search.json", q, key))
+	if err != nil {
+		lErr("Error while getting json from page ", page)
+		lErr(err)
+		report.apiError(err)
+		return
+	}
+
+	err = json.Unmarshal(body, &dats)
+
+	if err != nil {
+		lErr("Error while parsing search page", page)
+		lErr(err)
+		report.apiError(err)
+		if serr, ok := err.(*json.SyntaxError); ok { //In case crap was still given, we are looking at it.
+			lErr("Occurred at offset: ", serr.Offset)
 		}
+	}
+	return
+}
+
+//window is a span of image creation dates, from since up to, but not including, before. Zero end means there is no limit.
+//Server keeps fractions of second, so windows that share an end leave nothing between them
+type window struct {
+	since, before time.Time
+}
 
+//query appends date limits of window to the search
+func (w window) query(tag string) string {
+	terms := []string{"(" + tag + ")"} //Parentheses keep "a || b" from binding to date limits
+	if !w.since.IsZero() {
+		terms = append(terms, "created_at.gte:"+w.since.UTC().Format(time.RFC3339))
+	}
+	if !w.before.IsZero() {
+		terms = append(terms, "created_at.lt:"+w.before.UTC().Format(time.RFC3339))
+	}
+	if len(terms) == 1 {
+		return tag
 	}
+	return strings.Join(terms, ", ")
+}
+
+//splitWindow asks server how many images search holds and cuts too big searches in halves by time,
+//until every part is shallow enough. Parts are ordered from newest to oldest, same as search itself
+func splitWindow(ctx context.Context, tag, key string, w window) []window {
+
+	dats, err := searchPage(ctx, w.query(tag), key, 1)
+	if err != nil || dats.Total <= maxWindowImages {
+		return []window{w} //Problems would surface again when we actually crawl
+	}
+
+	since, until := w.since, w.before
+	if since.IsZero() {
+		since = derpiEpoch
+	}
+	if until.IsZero() {
+		until = now()
+	}
+	if until.Sub(since) < time.Hour { //Something is very popular this hour. Can't help it
+		return []window{w}
+	}
+
+	mid := since.Add(until.Sub(since) / 2).Truncate(time.Second)
+	lInfo("Search holds", dats.Total, "images, splitting it at", mid.UTC().Format(time.RFC3339))
 
-	close(imgchan)
+	newer := splitWindow(ctx, tag, key, window{since: mid, before: w.before})
+	older := splitWindow(ctx, tag, key, window{since: w.since, before: mid})
+	return append(newer, older...)
 }
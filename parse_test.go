@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowQuery(t *testing.T) {
+	w := window{}
+	if q := w.query("safe"); q != "safe" {
+		t.Error("Open window changed query into ", q)
+	}
+	w.since = time.Date(2017, time.December, 20, 0, 0, 0, 0, time.UTC)
+	if q := w.query("a || b"); q != "(a || b), created_at.gte:2017-12-20T00:00:00Z" {
+		t.Error("Window query is wrong: ", q)
+	}
+	w.before = w.since.AddDate(0, 0, 1)
+	if q := w.query("safe"); q != "(safe), created_at.gte:2017-12-20T00:00:00Z, created_at.lt:2017-12-21T00:00:00Z" {
+		t.Error("Window query with end is wrong: ", q)
+	}
+}
+
+func TestSplitWindow(t *testing.T) {
+	fixed := time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return fixed }
+	defer func() { now = time.Now }()
+
+	//Pretending there is one image every minute, so searches deeper than a week get sliced
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, until := derpiEpoch, fixed
+		for _, term := range strings.Split(r.URL.Query().Get("sbq"), ", ") {
+			if strings.HasPrefix(term, "created_at.gte:") {
+				since, _ = time.Parse(time.RFC3339, strings.TrimPrefix(term, "created_at.gte:"))
+			}
+			if strings.HasPrefix(term, "created_at.lt:") {
+				until, _ = time.Parse(time.RFC3339, strings.TrimPrefix(term, "created_at.lt:"))
+			}
+		}
+		_ = json.NewEncoder(w).Encode(Search{Total: int(until.Sub(since) / time.Minute)})
+	}))
+	defer ts.Close()
+
+	saved := derpiURL
+	defer func() { derpiURL = saved }()
+	u, _ := url.Parse(ts.URL)
+	derpiURL.Scheme, derpiURL.Host = u.Scheme, u.Host
+
+	whole := window{since: fixed.AddDate(0, 0, -30)}
+	windows := splitWindow(context.Background(), "safe", "", whole)
+	if len(windows) < 4 {
+		t.Fatal("Month of images wasn't split, got ", windows)
+	}
+	if !windows[0].before.IsZero() || !windows[len(windows)-1].since.Equal(whole.since) {
+		t.Error("Windows lost the ends of search: ", windows)
+	}
+	for i := 1; i < len(windows); i++ {
+		if !windows[i].before.Equal(windows[i-1].since) {
+			t.Error("Windows ", windows[i], " and ", windows[i-1], " are not adjacent")
+		}
+	}
+}
+
+func TestVariants(t *testing.T) {
+	saved := mediaOpts
+	defer func() { mediaOpts = saved }()
+
+	svg := RawImage{
+		Imgid:           1,
+		URL:             "//derpicdn.net/img/view/2017/12/20/1__safe.svg",
+		OriginalFormat:  "svg",
+		Representations: map[string]string{"full": "//derpicdn.net/img/view/2017/12/20/1.png"},
+	}
+	mediaOpts = &MediaOpts{SVG: "both"}
+	vs := variants(svg)
+	if len(vs) != 2 || vs[0].Filename != "1.svg" || vs[1].Filename != "1.png" {
+		t.Fatal("SVG variants are wrong: ", vs)
+	}
+	if vs[1].URL.String() != "https://derpicdn.net/img/view/2017/12/20/1.png" || vs[1].Format != "svg" {
+		t.Error("SVG render is taken from the wrong place: ", vs[1].URL, vs[1].Format)
+	}
+
+	mediaOpts = &MediaOpts{SVG: "raster"}
+	if vs = variants(svg); len(vs) != 1 || vs[0].Filename != "1.png" {
+		t.Error("Raster-only SVG variants are wrong: ", vs)
+	}
+
+	webm := RawImage{Imgid: 2, URL: "//derpicdn.net/img/view/2017/12/20/2.webm", OriginalFormat: "webm"}
+	mediaOpts = &MediaOpts{AnimatedAlt: FormatList{"webm", "mp4"}}
+	vs = variants(webm)
+	if len(vs) != 2 || vs[1].Filename != "2.mp4" || vs[1].URL.Path != "/img/view/2017/12/20/2.mp4" {
+		t.Error("Animated alternates are wrong: ", vs)
+	}
+}
+
+func TestTrimSized(t *testing.T) {
+	saved := mediaOpts
+	defer func() { mediaOpts = saved }()
+
+	dat := RawImage{
+		Imgid:          3,
+		URL:            "//derpicdn.net/img/view/2017/12/20/3__safe.svg",
+		OriginalFormat: "svg",
+		Size:           4096,
+		Representations: map[string]string{
+			"full":   "//derpicdn.net/img/view/2017/12/20/3.png",
+			"medium": "//derpicdn.net/img/2017/12/20/3/medium.png",
+		},
+	}
+
+	mediaOpts = &MediaOpts{Size: "full"}
+	if img := trim(dat); img.Filename != "3.svg" || img.URL.Path != "/img/view/2017/12/20/3.svg" {
+		t.Error("Full size is not original: ", img.Filename, img.URL)
+	}
+
+	mediaOpts = &MediaOpts{Size: "medium", SVG: "both"}
+	vs := variants(dat)
+	if len(vs) != 1 || vs[0].Filename != "3_medium.png" || vs[0].URL.String() != "https://derpicdn.net/img/2017/12/20/3/medium.png" || vs[0].Size != 0 {
+		t.Error("Medium size is taken wrong: ", vs)
+	}
+
+	mediaOpts = &MediaOpts{Size: "tall"}
+	if img := trim(dat); img.Filename != "3.svg" {
+		t.Error("Missing size didn't fall back to original: ", img.Filename)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+//listPrinter writes down images we would have downloaded, one by one
+type listPrinter interface {
+	row(img Image, target string) error
+	finish(n int, size int64) error
+}
+
+//listImages reads image data from channel and prints it instead of downloading. Nothing is written on disk
+func listImages(imgchan <-chan Image, opts *Config, format string, out io.Writer) {
+	p := newListPrinter(format, out)
+
+	var n, unknown int
+	var size int64
+	for imgdata := range imgchan {
+		if err := p.row(imgdata, constructFilepath(imgdata.Filename, opts.ImageDir)); err != nil {
+			lFatal("Could not print image list: ", err) //Stdout is gone, nothing to do here
+		}
+		n++
+		size += imgdata.Size
+		if imgdata.Size == 0 {
+			unknown++
+		}
+	}
+
+	if err := p.finish(n, size); err != nil {
+		lFatal("Could not print image list: ", err)
+	}
+	lInfof("Would download %d images, for a total of at least %s, size of %d is unknown", n, fmtbytes(float64(size)), unknown)
+}
+
+func newListPrinter(format string, out io.Writer) listPrinter {
+	switch format {
+	case "json":
+		return jsonPrinter{json.NewEncoder(out)}
+	case "csv":
+		return newCSVPrinter(out)
+	default:
+		return newTablePrinter(out)
+	}
+}
+
+//listEntry is how image looks in JSON list
+type listEntry struct {
+	ID     int    `json:"id"`
+	URL    string `json:"url"`
+	Score  int    `json:"score"`
+	Faves  int    `json:"faves"`
+	Size   int64  `json:"size"`
+	Target string `json:"target"`
+}
+
+type jsonPrinter struct {
+	enc *json.Encoder
+}
+
+func (p jsonPrinter) row(img Image, target string) error {
+	return p.enc.Encode(listEntry{img.Imgid, img.URL.String(), img.Score, img.Faves, img.Size, target})
+}
+
+//finish of JSON lines is left to log, so every line is an image
+func (p jsonPrinter) finish(int, int64) error {
+	return nil
+}
+
+type csvPrinter struct {
+	w *csv.Writer
+}
+
+func newCSVPrinter(out io.Writer) csvPrinter {
+	p := csvPrinter{csv.NewWriter(out)}
+	_ = p.w.Write([]string{"id", "url", "score", "faves", "size", "target"}) //Errors are sticky, we'll see them on flush
+	return p
+}
+
+func (p csvPrinter) row(img Image, target string) error {
+	return p.w.Write([]string{
+		strconv.Itoa(img.Imgid),
+		img.URL.String(),
+		strconv.Itoa(img.Score),
+		strconv.Itoa(img.Faves),
+		strconv.FormatInt(img.Size, 10),
+		target,
+	})
+}
+
+//finish of CSV is left to log, so every row is an image
+func (p csvPrinter) finish(int, int64) error {
+	p.w.Flush()
+	return p.w.Error()
+}
+
+type tablePrinter struct {
+	tb *tabwriter.Writer
+}
+
+func newTablePrinter(out io.Writer) tablePrinter {
+	p := tablePrinter{tabwriter.NewWriter(out, 4, 8, 2, ' ', 0)}
+	fmt.Fprintln(p.tb, "ID\tScore\tFaves\tSize\tTarget\tURL")
+	return p
+}
+
+func (p tablePrinter) row(img Image, target string) error {
+	size := "?"
+	if img.Size != 0 {
+		size = fmtbytes(float64(img.Size))
+	}
+	_, err := fmt.Fprintf(p.tb, "%d\t%d\t%d\t%s\t%s\t%s\n", img.Imgid, img.Score, img.Faves, size, target, img.URL)
+	return err
+}
+
+func (p tablePrinter) finish(n int, size int64) error {
+	fmt.Fprintf(p.tb, "Total: %d\t\t\t%s\t\t\n", n, fmtbytes(float64(size)))
+	return p.tb.Flush() //Table is written only now, when all column widths are known
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func testList(format string) string {
+	in := make(chan Image, 2)
+	u, _ := url.Parse("https://derpicdn.net/img/view/1.png")
+	in <- Image{Imgid: 1, URL: u, Filename: "1.png", Score: 10, Faves: 5, Size: 2048}
+	in <- Image{Imgid: 2, URL: u, Filename: "2.png"}
+	close(in)
+
+	var out bytes.Buffer
+	listImages(in, &Config{ImageDir: "img"}, format, &out)
+	return out.String()
+}
+
+func TestListJSON(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(testList("json")), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected two JSON lines, got ", lines)
+	}
+	var e listEntry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil || e.ID != 1 || e.Size != 2048 || e.Target != constructFilepath("1.png", "img") {
+		t.Error("JSON line is wrong: ", lines[0], err)
+	}
+}
+
+func TestListCSV(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(testList("csv")), "\n")
+	if len(lines) != 3 || lines[0] != "id,url,score,faves,size,target" || !strings.HasPrefix(lines[1], "1,https://derpicdn.net/img/view/1.png,10,5,2048,") {
+		t.Error("CSV is wrong: ", lines)
+	}
+}
+
+func TestListTable(t *testing.T) {
+	table := testList("table")
+	if !strings.Contains(table, "Total: 2") || !strings.Contains(table, "2.00 KiB") {
+		t.Error("Table doesn't sum up images: ", table)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//progress is live view of downloads. It is nil when stdout is not a terminal, then plain log lines are used instead.
+//All of its methods are fine to call on nil
+var progress *progressView
+
+const (
+	barWidth        = 30
+	progressRefresh = 200 * time.Millisecond
+)
+
+//progressView draws a bar for every worker and overall progress below them. Log lines are printed above it
+type progressView struct {
+	mu    sync.Mutex
+	out   io.Writer
+	bars  []*workerBar
+	done  int
+	total int
+	bytes int64
+	start time.Time
+	drawn int //How many lines we need to climb to redraw everything
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+//workerBar is progress of single download
+type workerBar struct {
+	view *progressView
+	name string
+	size int64 //Negative or zero when server didn't tell us
+	got  int64
+}
+
+//isTerminal tells if file is something user is looking at, not a pipe or a file
+func isTerminal(f *os.File) bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgressView(out io.Writer, workers int) *progressView {
+	v := &progressView{out: out, start: time.Now(), stop: make(chan struct{})}
+	for k := 0; k < workers; k++ {
+		v.bars = append(v.bars, &workerBar{view: v})
+	}
+
+	v.wg.Add(1)
+	go func() { //Speed and ETA change even when nothing happens
+		defer v.wg.Done()
+		tick := time.NewTicker(progressRefresh)
+		defer tick.Stop()
+		for {
+			select {
+			case <-v.stop:
+				return
+			case <-tick.C:
+				v.mu.Lock()
+				v.redraw(nil)
+				v.mu.Unlock()
+			}
+		}
+	}()
+	return v
+}
+
+//Write lets log lines pass above the progress view, so they don't get mixed with bars
+func (v *progressView) Write(p []byte) (int, error) {
+	if v == nil {
+		return len(p), nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(p), v.redraw(p)
+}
+
+//aside returns writer for lines that go into other stream, like errors into stderr. View is cleared before them
+//and drawn again after, so on terminal they don't get mixed with bars, while redirected stream gets lines only
+func (v *progressView) aside(w io.Writer) io.Writer {
+	if v == nil {
+		return w
+	}
+	return asideWriter{view: v, w: w}
+}
+
+type asideWriter struct {
+	view *progressView
+	w    io.Writer
+}
+
+func (a asideWriter) Write(p []byte) (int, error) {
+	v := a.view
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.drawn > 0 {
+		_, _ = fmt.Fprintf(v.out, "\x1b[%dA\x1b[J", v.drawn) //Broken terminal would show up in redraw
+		v.drawn = 0
+	}
+	n, err := a.w.Write(p)
+	if rerr := v.redraw(nil); err == nil {
+		err = rerr
+	}
+	return n, err
+}
+
+//close stops refreshing and leaves last state of view on screen
+func (v *progressView) close() {
+	if v == nil {
+		return
+	}
+	close(v.stop)
+	v.wg.Wait()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.bars = nil
+	_ = v.redraw(nil) //Nothing to do about broken terminal at the very end
+}
+
+//addTotal notes that more images are expected
+func (v *progressView) addTotal(n int) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	v.total += n
+	v.mu.Unlock()
+}
+
+//imageDone notes that one more image was dealt with, downloaded, skipped or filtered out
+func (v *progressView) imageDone() {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	v.done++
+	v.mu.Unlock()
+}
+
+//bar returns bar of k-th worker
+func (v *progressView) bar(k int) *workerBar {
+	if v == nil || k >= len(v.bars) {
+		return nil
+	}
+	return v.bars[k]
+}
+
+//redraw climbs over previously drawn view, clearing it, prints log lines, if any, and draws view anew. Lock must be held
+func (v *progressView) redraw(logline []byte) error {
+	var b strings.Builder
+	if v.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", v.drawn)
+	}
+	b.WriteString("\x1b[J")
+	b.Write(logline)
+
+	lines := v.render()
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteString("\n")
+	}
+	v.drawn = len(lines)
+
+	_, err := io.WriteString(v.out, b.String())
+	return err
+}
+
+//render makes text lines of view, bars first, summary last
+func (v *progressView) render() []string {
+	var lines []string
+	for k, bar := range v.bars {
+		if bar.name == "" {
+			lines = append(lines, fmt.Sprintf("[%d] idle", k+1))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("[%d] %s %s", k+1, drawBar(bar.got, bar.size), bar.name))
+	}
+
+	elapsed := time.Since(v.start).Seconds()
+	speed := 0.0
+	if elapsed > 0 {
+		speed = float64(v.bytes) / elapsed
+	}
+	eta := "?"
+	if v.done > 0 && v.total > v.done {
+		left := time.Duration(float64(v.total-v.done) / float64(v.done) * elapsed * float64(time.Second))
+		eta = left.Truncate(time.Second).String()
+	}
+	total := "?"
+	if v.total > 0 {
+		total = fmt.Sprint(v.total)
+	}
+	lines = append(lines, fmt.Sprintf("Images %d/%s, %s at %s/s, ETA %s", v.done, total, fmtbytes(float64(v.bytes)), fmtbytes(speed), eta))
+	return lines
+}
+
+//drawBar draws bar as [#####.....] with amount of bytes. Unknown size is drawn empty
+func drawBar(got, size int64) string {
+	filled := 0
+	if size > 0 {
+		filled = int(got * barWidth / size)
+		if filled > barWidth {
+			filled = barWidth
+		}
+	}
+	bar := "[" + strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled) + "]"
+	if size > 0 {
+		return fmt.Sprintf("%s %s/%s", bar, fmtbytes(float64(got)), fmtbytes(float64(size)))
+	}
+	return fmt.Sprintf("%s %s", bar, fmtbytes(float64(got)))
+}
+
+//begin starts showing download of file of given size
+func (b *workerBar) begin(name string, size int64) {
+	if b == nil {
+		return
+	}
+	b.view.mu.Lock()
+	b.name, b.size, b.got = name, size, 0
+	b.view.mu.Unlock()
+}
+
+//end shows worker as idle
+func (b *workerBar) end() {
+	if b == nil {
+		return
+	}
+	b.view.mu.Lock()
+	b.name = ""
+	b.view.mu.Unlock()
+}
+
+//Write counts bytes passing through, so bar could be put into io.TeeReader
+func (b *workerBar) Write(p []byte) (int, error) {
+	if b == nil {
+		return len(p), nil
+	}
+	b.view.mu.Lock()
+	b.got += int64(len(p))
+	b.view.bytes += int64(len(p))
+	b.view.mu.Unlock()
+	return len(p), nil
+}
+
+//progressState is what view shows, for those who look at it from elsewhere
+type progressState struct {
+	Done    int        `json:"done"`
+	Total   int        `json:"total"` //Zero while unknown
+	Bytes   int64      `json:"bytes"`
+	Workers []barState `json:"workers,omitempty"`
+}
+
+//barState is download single worker is busy with, file is empty when it is idle
+type barState struct {
+	File string `json:"file,omitempty"`
+	Got  int64  `json:"got"`
+	Size int64  `json:"size"`
+}
+
+//state tells where view is right now
+func (v *progressView) state() progressState {
+	if v == nil {
+		return progressState{}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	st := progressState{Done: v.done, Total: v.total, Bytes: v.bytes}
+	for _, bar := range v.bars {
+		st.Workers = append(st.Workers, barState{File: bar.name, Got: bar.got, Size: bar.size})
+	}
+	return st
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDrawBar(t *testing.T) {
+	if b := drawBar(512, 1024); !strings.HasPrefix(b, "["+strings.Repeat("#", barWidth/2)+strings.Repeat(".", barWidth/2)+"]") {
+		t.Error("Half-done bar is drawn wrong: ", b)
+	}
+	if b := drawBar(4096, -1); strings.Contains(b, "#") || !strings.HasSuffix(b, "4.00 KiB") {
+		t.Error("Bar of unknown size is drawn wrong: ", b)
+	}
+}
+
+func TestProgressLogPassthrough(t *testing.T) {
+	var out bytes.Buffer
+	v := newProgressView(&out, 2)
+	v.addTotal(10)
+	v.bar(0).begin("1.png", 100)
+	_, _ = v.bar(0).Write(make([]byte, 50))
+	v.imageDone()
+
+	if _, err := v.Write([]byte("Happened at now Something\n")); err != nil {
+		t.Fatal(err)
+	}
+	var errs bytes.Buffer
+	if _, err := v.aside(&errs).Write([]byte("Error at now Broken\n")); err != nil {
+		t.Fatal(err)
+	}
+	if errs.String() != "Error at now Broken\n" || strings.Contains(out.String(), "Broken") {
+		t.Error("Error line didn't go into its own stream: ", errs.String())
+	}
+	v.close()
+
+	s := out.String()
+	first := strings.Index(s, "Happened at now Something\n")
+	if first < 0 || !strings.Contains(s[first:], "Images 1/10") {
+		t.Error("Log line is not printed above view: ", s)
+	}
+	if !strings.Contains(s, "\x1b[3A") {
+		t.Error("View isn't cleared before log line: ", s)
+	}
+}
+
+func TestProgressNil(t *testing.T) {
+	var v *progressView
+	v.addTotal(1)
+	v.imageDone()
+	v.bar(0).begin("1.png", 1)
+	if n, err := v.bar(0).Write([]byte("abc")); n != 3 || err != nil {
+		t.Error("Nil bar doesn't pretend to write")
+	}
+	v.close()
+}
+
+func TestExpectedImages(t *testing.T) {
+	if n := expectedImages(1000, 50, 1, 0); n != 1000 {
+		t.Error("Whole search expected as ", n)
+	}
+	if n := expectedImages(1000, 50, 3, 7); n != 250 {
+		t.Error("Pages 3 to 7 expected as ", n)
+	}
+	if n := expectedImages(100, 50, 5, 0); n != 0 {
+		t.Error("Pages past the end expected as ", n)
+	}
+}
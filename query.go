@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,8 +16,8 @@ import (
 	"time"
 )
 
-func getJSON(source string) (body []byte, err error) {
-	response, err := http.Get(source)
+func getJSON(ctx context.Context, source string) (body []byte, err error) {
+	response, err := get(ctx, source)
 	//Getting our nice http response.
 
 	//This error check may be given it's own function, later. Not sure of best way to do it.
@@ -25,8 +27,8 @@ func getJSON(source string) (body []byte, err error) {
 	}
 
 	defer func() {
-		err = response.Body.Close() //and not forgetting to close it when it's done. And before we panic and die horribly.
-		if err != nil {
+		cerr := response.Body.Close() //and not forgetting to close it when it's done. And before we panic and die horribly.
+		if cerr != nil {
 			lFatal("Could  not close server response")
 		}
 	}()
@@ -43,7 +45,20 @@ func getJSON(source string) (body []byte, err error) {
 	return body, nil
 }
 
+//get is http.Get that could be cancelled
+func get(ctx context.Context, source string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	metrics.requested(req, time.Since(start), err)
+	return resp, err
+}
+
 func okHTTPStatus(chk *http.Response) bool {
+	metrics.status(chk)
 	switch chk.StatusCode {
 	case http.StatusOK, http.StatusNotModified:
 		return true
@@ -113,15 +128,16 @@ func checkUserResponse() bool {
 	return false
 }
 
-func (imgdata Image) saveImage(opts *Config) (size int64, ok bool) { // To not hold all the files open when there is no need. All file descriptors are in the scope of this function.
+//errNoClobber is returned when image is already on disk and we didn't download it again
+var errNoClobber = errors.New("already downloaded")
 
-	filepath := constructFilepath(imgdata.Filename, opts.ImageDir)
+func (imgdata Image) saveImage(ctx context.Context, store Storage, bar *workerBar) (size int64, err error) { // To not hold all the files open when there is no need. All file descriptors are in the scope of this function.
 
-	fsize := getFileSize(filepath)
+	fsize := store.Size(imgdata.Filename)
 
 	start := time.Now() //Timing download time. We can't begin it sooner, not sure if we can begin it later
 
-	response, err := http.Get(imgdata.URL.String())
+	response, err := get(ctx, imgdata.URL.String())
 
 	if err != nil {
 		lErr("Error when getting image: ", imgdata.Imgid)
@@ -130,55 +146,69 @@ func (imgdata Image) saveImage(opts *Config) (size int64, ok bool) { // To not h
 	}
 
 	defer func() {
-		err = response.Body.Close()
-		if err != nil {
+		if cerr := response.Body.Close(); cerr != nil {
 			lFatal("Could not close server response")
 		}
 	}()
 
 	if !okHTTPStatus(response) {
-		return
+		return 0, &statusError{response.Status}
 	}
 
 	expsize := getRemoteSize(response.Header)
 
 	if expsize == fsize {
-		lInfo("Skipping: no-clobber")
-		return
+		lDetail("Skipping: no-clobber")
+		return 0, errNoClobber
 	}
 
-	if err != nil {
-		lErr("Error when getting image: ", imgdata.Imgid)
-		lErr(err)
-		return
-	}
-
-	output, err := os.Create(filepath) //And now, THE FILE! New, truncated, ready to write
+	output, err := store.Create(imgdata.Filename)
 	if err != nil {
 		lErr("Error when creating file for image: ", imgdata.Imgid)
 		lErr(err) //Either we got no permission or no space, end of line
 		return
 	}
 	defer func() {
-		err = output.Close() //Not forgetting to deal with it after completing download
-		if err != nil {
-			lFatal("Could  not close downloaded file")
+		if err == nil {
+			return
+		}
+		if aerr := output.Abort(); aerr != nil { //Half of image is no image
+			lErr("Could not remove partially downloaded file", imgdata.Filename)
+			lErr(aerr)
 		}
 	}()
 
-	size, err = io.Copy(output, response.Body) //Preventing creation of temporary buffer in memory
+	bar.begin(imgdata.Filename, expsize)
+	defer bar.end()
+
+	size, err = io.Copy(output, io.TeeReader(response.Body, bar)) //Preventing creation of temporary buffer in memory
+	metrics.transferred(size)
 	if err != nil {
-		lErr("Unable to write image on disk, id: ", imgdata.Imgid)
-		lErr(err)
+		lErrw("Unable to write image on disk", logFields{"image_id": imgdata.Imgid, "error": err})
+		return
+	}
+	if err = output.Close(); err != nil { //Not forgetting to deal with it after completing download
+		lErrw("Could not close downloaded file", logFields{"image_id": imgdata.Imgid, "error": err})
 		return
 	}
 	timed := time.Since(start).Seconds()
 
-	lInfof("Downloaded %d bytes in %.2fs, speed %s/s\n", size, timed, fmtbytes(float64(size)/timed))
-	ok = true
+	lDetailw(fmt.Sprintf("Downloaded %d bytes in %.2fs, speed %s/s", size, timed, fmtbytes(float64(size)/timed)),
+		logFields{"image_id": imgdata.Imgid, "bytes": size, "duration": timed})
 
-	if expsize != size {
-		lErr("Unable to download full image")
+	if expsize >= 0 && expsize != size {
+		lErrw("Unable to download full image", logFields{"image_id": imgdata.Imgid, "bytes": size})
+		return size, fmt.Errorf("%w, got %d bytes out of %d", errIncomplete, size, expsize)
+	}
+
+	if mediaOpts.EmbedMeta {
+		if merr := embedFile(imgdata, output.Path()); merr != nil {
+			lWarn("Could not embed metadata into", imgdata.Filename+":", merr)
+		}
+	}
+	if err = output.Commit(); err != nil {
+		lErrw("Could not put image into storage", logFields{"image_id": imgdata.Imgid, "error": err})
+		return
 	}
 	return
 }
@@ -195,8 +225,9 @@ func getFileSize(path string) int64 {
 func getRemoteSize(head http.Header) (expsize int64) {
 
 	sizestring, ok := head["Content-Length"]
-	if !ok {
+	if !ok || len(sizestring) == 0 { //Happens with videos, they are streamed sometimes
 		lErr("Filesize not provided")
+		return -1
 	}
 
 	expsize, err := strconv.ParseInt(sizestring[0], 10, 64)
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveImageAbortRemovesPartial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "2048")
+		_, _ = w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		cancel() //User got bored halfway through
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	u, _ := url.Parse(ts.URL + "/1.png")
+	img := Image{Imgid: 1, URL: u, Filename: "1.png"}
+
+	if _, err := img.saveImage(ctx, newDirStorage(dir), nil); err == nil {
+		t.Error("Aborted download reported as done")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.png")); !os.IsNotExist(err) {
+		t.Error("Partial file was left behind: ", err)
+	}
+}
+
+func TestSaveImage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not really a png"))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	u, _ := url.Parse(ts.URL + "/1.png")
+	img := Image{Imgid: 1, URL: u, Filename: "1.png"}
+
+	if size, err := img.saveImage(context.Background(), newDirStorage(dir), nil); err != nil || size != 16 {
+		t.Error("Download failed, got ", size, " bytes: ", err)
+	}
+	if getFileSize(filepath.Join(dir, "1.png")) != 16 {
+		t.Error("Downloaded file is wrong")
+	}
+	if _, err := img.saveImage(context.Background(), newDirStorage(dir), nil); err != errNoClobber {
+		t.Error("Downloaded file was not skipped: ", err)
+	}
+}
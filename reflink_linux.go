@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+//reflink clones src into new file dst, sharing blocks with it, with the same mode. Works on btrfs, xfs and alike
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //Read-only, nothing to lose
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if err == nil {
+		err = out.Chmod(fi.Mode().Perm()) //Clone is the same file to anyone who looks at it
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst) //Empty file is no clone
+		if err == unix.EOPNOTSUPP || err == unix.EXDEV || err == unix.EINVAL {
+			return errReflinkUnsupported
+		}
+	}
+	return err
+}
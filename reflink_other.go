@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+//reflink is not done outside of Linux yet
+func reflink(src, dst string) error {
+	return errReflinkUnsupported
+}
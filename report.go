@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+//Exit codes, so scripts running us could tell what happened
+const (
+	exitOK             = 0
+	exitFatal          = 1 //Something we couldn't recover from, see lFatal
+	exitPartial        = 2 //Some images or pages failed, others are fine
+	exitAPIUnreachable = 3 //Couldn't get anything from Derpibooru at all
+	exitInterrupted    = 130
+)
+
+//outcome is what happened to single image
+type outcome string
+
+const (
+	outcomeDownloaded outcome = "downloaded"
+	outcomeSkipped    outcome = "skipped-existing"
+	outcomeFiltered   outcome = "filtered"
+	outcomeFailed     outcome = "failed"
+)
+
+//report collects what happened during the run, to be written down at the end
+var report = newRunReport()
+
+//imageResult is what happened to single image
+type imageResult struct {
+	ID      int     `json:"id"`
+	File    string  `json:"file"`
+	Outcome outcome `json:"outcome"`
+	Reason  string  `json:"reason,omitempty"`
+	Bytes   int64   `json:"bytes,omitempty"`
+}
+
+//runReport is machine-readable summary of the run
+type runReport struct {
+	mu sync.Mutex
+
+	Started     time.Time       `json:"started"`
+	Finished    time.Time       `json:"finished"`
+	ExitCode    int             `json:"exit_code"`
+	Interrupted bool            `json:"interrupted"`
+	Totals      map[outcome]int `json:"totals"`
+	Bytes       int64           `json:"bytes"`
+	APIErrors   []string        `json:"api_errors,omitempty"`
+	Hooks       []hookFailure   `json:"hook_failures,omitempty"` //Don't count against exit code, images are downloaded all the same
+	Images      []imageResult   `json:"images"`
+}
+
+func newRunReport() *runReport {
+	return &runReport{
+		Started: time.Now(),
+		Totals:  map[outcome]int{outcomeDownloaded: 0, outcomeSkipped: 0, outcomeFiltered: 0, outcomeFailed: 0},
+	}
+}
+
+//add notes what happened to image after we are done with it. Error tells whether and how it failed
+func (r *runReport) add(img Image, o outcome, size int64, err error) {
+	res := imageResult{ID: img.Imgid, File: img.Filename, Outcome: o, Bytes: size}
+	if err != nil {
+		res.Reason = err.Error()
+	}
+
+	r.mu.Lock()
+	r.Images = append(r.Images, res)
+	r.Totals[o]++
+	r.Bytes += size
+	r.mu.Unlock()
+
+	metrics.image(o)
+	progress.imageDone()
+	checkpoint.completed(img)
+}
+
+//downloaded sorts out result of saveImage
+func (r *runReport) downloaded(img Image, size int64, err error) {
+	switch {
+	case err == nil:
+		r.add(img, outcomeDownloaded, size, nil)
+		journal.succeeded(img)
+		catalogue.noted(img)
+	case errors.Is(err, errNoClobber):
+		r.add(img, outcomeSkipped, 0, nil)
+		journal.succeeded(img)
+		catalogue.noted(img)
+	default:
+		r.add(img, outcomeFailed, size, err)
+		journal.failed(img, err)
+	}
+}
+
+//apiError notes that we couldn't get or understand something from Derpibooru
+func (r *runReport) apiError(err error) {
+	r.mu.Lock()
+	r.APIErrors = append(r.APIErrors, err.Error())
+	r.mu.Unlock()
+}
+
+//hookFailed notes that user's hook command failed
+func (r *runReport) hookFailed(f hookFailure) {
+	r.mu.Lock()
+	r.Hooks = append(r.Hooks, f)
+	r.mu.Unlock()
+}
+
+//exitCode sums up run into single number
+func (r *runReport) exitCode(interrupted bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case interrupted:
+		return exitInterrupted
+	case len(r.APIErrors) != 0 && len(r.Images) == 0:
+		return exitAPIUnreachable
+	case len(r.APIErrors) != 0 || r.Totals[outcomeFailed] != 0:
+		return exitPartial
+	default:
+		return exitOK
+	}
+}
+
+//finish closes report with final result
+func (r *runReport) finish(interrupted bool) int {
+	code := r.exitCode(interrupted)
+	r.mu.Lock()
+	r.Finished = time.Now()
+	r.ExitCode = code
+	r.Interrupted = interrupted
+	r.mu.Unlock()
+	return code
+}
+
+//write puts report into file as JSON
+func (r *runReport) write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(r); err != nil {
+		_ = out.Close() //First error is more interesting
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReportExitCodes(t *testing.T) {
+	r := newRunReport()
+	r.downloaded(Image{Imgid: 1}, 10, nil)
+	r.downloaded(Image{Imgid: 2}, 0, errNoClobber)
+	r.add(Image{Imgid: 3}, outcomeFiltered, 0, nil)
+	if code := r.exitCode(false); code != exitOK {
+		t.Error("All-ok run exits with ", code)
+	}
+	if code := r.exitCode(true); code != exitInterrupted {
+		t.Error("Interrupted run exits with ", code)
+	}
+
+	r.downloaded(Image{Imgid: 4}, 5, errors.New("connection reset"))
+	if code := r.exitCode(false); code != exitPartial {
+		t.Error("Partially failed run exits with ", code)
+	}
+
+	r = newRunReport()
+	r.apiError(errors.New("no such host"))
+	if code := r.exitCode(false); code != exitAPIUnreachable {
+		t.Error("Run without API exits with ", code)
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	r := newRunReport()
+	r.downloaded(Image{Imgid: 1, Filename: "1.png"}, 10, nil)
+	r.downloaded(Image{Imgid: 2, Filename: "2.png"}, 0, errors.New("server response: 404 Not Found"))
+	r.finish(false)
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := r.write(path); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got runReport
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ExitCode != exitPartial || got.Totals[outcomeDownloaded] != 1 || got.Totals[outcomeFailed] != 1 || got.Bytes != 10 {
+		t.Error("Report sums up wrong: ", string(raw))
+	}
+	if len(got.Images) != 2 || got.Images[1].Reason != "server response: 404 Not Found" {
+		t.Error("Report lost reason of failure: ", got.Images)
+	}
+}
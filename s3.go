@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//abortUploadTimeout is how long server is waited for, when multipart upload that failed is being cleaned up
+const abortUploadTimeout = 10 * time.Second
+
+//minPartSize is the smallest part S3 takes in multipart upload, except for the last one
+const minPartSize = 5 << 20
+
+//s3Storage puts images into bucket of S3-compatible server, like MinIO. Requests are signed with AWS signature version 4.
+//Bucket is addressed by path, as MinIO likes it
+type s3Storage struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	partSize int64
+	access   string
+	secret   string
+	client   *http.Client
+	now      func() time.Time
+	ctx      context.Context //Requests are dropped when it's done, so abort stops uploads too
+}
+
+func newS3Storage(ctx context.Context, opts *S3Opts, access, secret string) (*s3Storage, error) {
+	u, err := url.Parse(opts.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %s is not an URL", opts.S3Endpoint)
+	}
+	if access == "" || secret == "" {
+		return nil, errors.New("no S3 credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	s := &s3Storage{
+		endpoint: u,
+		bucket:   opts.S3Bucket,
+		prefix:   opts.S3Prefix,
+		region:   opts.S3Region,
+		partSize: int64(opts.S3PartSize),
+		access:   access,
+		secret:   secret,
+		client:   http.DefaultClient,
+		now:      time.Now,
+		ctx:      ctx,
+	}
+	if s.partSize < minPartSize {
+		s.partSize = minPartSize
+	}
+	return s, nil
+}
+
+//s3Error is what S3 says when it refuses something
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+	Status  string `xml:"-"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return "S3: " + e.Status
+	}
+	return "S3: " + e.Status + ", " + e.Code + ": " + e.Message
+}
+
+//uriEncode escapes string the way signature wants it. Only slashes of path are left as they are
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+//canonicalQuery is query sorted by keys and escaped, the same for URL and signature
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) //Hash never fails
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//sign adds AWS signature version 4 to request. Host and every header request has are signed
+func (s *s3Storage) sign(req *http.Request, payloadHash string) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	uri := uriEncode(req.URL.Path, false)
+	if uri == "" {
+		uri = "/"
+	}
+	canonical := strings.Join([]string{req.Method, uri, canonicalQuery(req.URL.Query()), canonHeaders.String(), signed, payloadHash}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+s.secret), day), s.region), "s3"), "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.access+"/"+scope+", SignedHeaders="+signed+
+		", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+//objectURL is where object lives
+func (s *s3Storage) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	u.Path = path.Join("/", u.Path, s.bucket, s.prefix+name)
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+//do sends signed request about object. Anything but success is an error
+func (s *s3Storage) do(ctx context.Context, method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.objectURL(name)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, sha256Hex(body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close() //Only error is in there
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodHead {
+		return nil, os.ErrNotExist
+	}
+	serr := &s3Error{Status: resp.Status}
+	if raw, rerr := ioutil.ReadAll(resp.Body); rerr == nil {
+		_ = xml.Unmarshal(raw, serr) //HEAD has no body, and error is still an error without details
+	}
+	return nil, serr
+}
+
+//head gets headers of object
+func (s *s3Storage) head(name string) (*http.Response, error) {
+	resp, err := s.do(s.ctx, http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close() //Nothing in there
+	return resp, nil
+}
+
+func (s *s3Storage) Exists(name string) bool {
+	_, err := s.head(name)
+	return err == nil
+}
+
+//Size is taken from metadata, if object has metadata embedded
+func (s *s3Storage) Size(name string) int64 {
+	resp, err := s.head(name)
+	if err != nil {
+		return 0
+	}
+	if orig, err := strconv.ParseInt(resp.Header.Get("X-Amz-Meta-Orig-Size"), 10, 64); err == nil {
+		return orig
+	}
+	return resp.ContentLength
+}
+
+//Hash is noted in metadata of object when it's uploaded
+func (s *s3Storage) Hash(name string) (string, error) {
+	resp, err := s.head(name)
+	if err != nil {
+		return "", err
+	}
+	if h := resp.Header.Get("X-Amz-Meta-Sha256"); h != "" {
+		return h, nil
+	}
+	return "", errors.New("no hash noted for " + name)
+}
+
+func (s *s3Storage) Create(name string) (Upload, error) {
+	return newTempUpload(name, func(path string, size int64, hash string) error { return s.put(name, path, size, hash) })
+}
+
+func (s *s3Storage) Remove(name string) error {
+	resp, err := s.do(s.ctx, http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Close() error {
+	return nil
+}
+
+//put uploads file, in one go or in parts if it's big. Size and hash are of file as it came from server
+func (s *s3Storage) put(name, file string, size int64, hash string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //Read-only, nothing to lose
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"X-Amz-Meta-Sha256": {hash}}
+	if fi.Size() != size {
+		header.Set("X-Amz-Meta-Orig-Size", strconv.FormatInt(size, 10))
+	}
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+
+	if fi.Size() <= s.partSize {
+		body, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(s.ctx, http.MethodPut, name, nil, header, body)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return s.putParts(name, in, header)
+}
+
+type multipartInit struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type multipartComplete struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+//putParts is multipart upload. If any part fails, whole upload is aborted, so no parts are left lying around
+func (s *s3Storage) putParts(name string, in io.Reader, header http.Header) (err error) {
+	resp, err := s.do(s.ctx, http.MethodPost, name, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var init multipartInit
+	err = xml.NewDecoder(resp.Body).Decode(&init)
+	_ = resp.Body.Close() //Read already
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), abortUploadTimeout) //Parts are cleaned up even when upload is aborted
+		defer cancel()
+		if resp, aerr := s.do(ctx, http.MethodDelete, name, url.Values{"uploadId": {init.UploadID}}, nil, nil); aerr == nil {
+			_ = resp.Body.Close() //Nothing in there
+		}
+	}()
+
+	var done multipartComplete
+	buf := make([]byte, s.partSize)
+	for n := 1; ; n++ {
+		read, rerr := io.ReadFull(in, buf)
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {init.UploadID}}
+		resp, err := s.do(s.ctx, http.MethodPut, name, q, nil, buf[:read])
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close() //Only ETag matters
+		done.Parts = append(done.Parts, completePart{n, resp.Header.Get("ETag")})
+		lDetailw("Uploaded part "+strconv.Itoa(n)+" of "+name, logFields{"file": name, "bytes": read})
+		if rerr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(done)
+	if err != nil {
+		return err
+	}
+	resp, err = s.do(s.ctx, http.MethodPost, name, url.Values{"uploadId": {init.UploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //Read-only, nothing to lose
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(raw, []byte("<Error>")) { //S3 may fail completing upload after it said everything is fine
+		serr := &s3Error{Status: resp.Status}
+		_ = xml.Unmarshal(raw, serr) //It is an error either way
+		return serr
+	}
+	return nil
+}
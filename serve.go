@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/jessevdk/go-flags"
+)
+
+//jobsDir is directory in target directory where server keeps its queue and reports of jobs. Hidden, so it's not taken for images
+const jobsDir = ".jobs"
+
+//queueName is file in jobsDir with all jobs server knows about
+const queueName = "queue.json"
+
+//keepJobs is how many finished jobs are remembered. Their reports stay even when jobs are forgotten
+const keepJobs = 100
+
+//States of job, in order they go through. Job that is interrupted by server going down is queued again
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobFinished  = "finished"
+	jobCancelled = "cancelled"
+)
+
+//jobRequest is what is asked to be downloaded, as posted to /jobs
+type jobRequest struct {
+	Tag       string            `json:"tag,omitempty"`
+	IDs       []int             `json:"ids,omitempty"`
+	StartPage int               `json:"start_page,omitempty"`
+	StopPage  int               `json:"stop_page,omitempty"`
+	Filters   map[string]string `json:"filters,omitempty"` //Filter flags without dashes, like "score": "100" or "since": "7d"
+}
+
+//job is single download, queued or done
+type job struct {
+	ID int `json:"id"`
+	jobRequest
+	State       string        `json:"state"`
+	Created     time.Time     `json:"created_at"`
+	Started     *time.Time    `json:"started_at,omitempty"`
+	Finished    *time.Time    `json:"finished_at,omitempty"`
+	ExitCode    int           `json:"exit_code"` //Same as ponydownloader would exit with, after job is finished
+	Interrupted bool          `json:"interrupted,omitempty"`
+	Progress    progressState `json:"progress"`
+	Report      string        `json:"report,omitempty"` //Name of report file in jobsDir
+
+	cancel context.CancelFunc //Running job only
+	view   *progressView
+}
+
+//jobQueue runs jobs one by one: parsers, filters and downloaders share state, so only one job could have them
+type jobQueue struct {
+	mu   sync.Mutex
+	dir  string //Target directory
+	jobs []*job
+	next int
+	wake chan struct{}
+}
+
+//parseFilters reads filters of job the same way flags are read, so they mean the same things and are checked the same way
+func parseFilters(filters map[string]string) (*FiltOpts, error) {
+	args := make([]string, 0, len(filters))
+	for k, v := range filters {
+		args = append(args, "--"+k+"="+v)
+	}
+	sort.Strings(args) //Same error for the same job every time
+	opts := new(FiltOpts)
+	if _, err := flag.NewParser(opts, flag.None).ParseArgs(args); err != nil {
+		return nil, err
+	}
+	opts.flagsPresent(args)
+	return opts, nil
+}
+
+//check tells what is wrong with request, if anything
+func (r *jobRequest) check() error {
+	switch {
+	case r.Tag == "" && len(r.IDs) == 0:
+		return errors.New("nothing to download, give tag or ids")
+	case r.Tag != "" && len(r.IDs) != 0:
+		return errors.New("give either tag or ids, not both")
+	case r.StartPage < 0 || r.StopPage < 0:
+		return errors.New("pages can't be negative")
+	}
+	for _, id := range r.IDs {
+		if id < 0 {
+			return fmt.Errorf("wrong image id %d", id)
+		}
+	}
+	_, err := parseFilters(r.Filters)
+	return err
+}
+
+//loadJobQueue reads queue server left in target directory. Jobs that were running when it went down are queued again
+func loadJobQueue(dir string) (*jobQueue, error) {
+	q := &jobQueue{dir: dir, next: 1, wake: make(chan struct{}, 1)}
+	if err := os.MkdirAll(constructFilepath(jobsDir, dir), 0700); err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(q.path())
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(raw, &q.jobs); err != nil {
+		return nil, err
+	}
+	for _, j := range q.jobs {
+		if j.State == jobRunning {
+			j.State, j.Interrupted = jobQueued, true
+		}
+		if j.ID >= q.next {
+			q.next = j.ID + 1
+		}
+	}
+	return q, nil
+}
+
+func (q *jobQueue) path() string {
+	return filepath.Join(constructFilepath(jobsDir, q.dir), queueName)
+}
+
+//save writes queue down, replacing old one whole. Call with lock held
+func (q *jobQueue) save() {
+	raw, err := json.MarshalIndent(q.jobs, "", "  ")
+	if err == nil {
+		tmp := q.path() + ".tmp"
+		if err = ioutil.WriteFile(tmp, raw, 0600); err == nil {
+			err = os.Rename(tmp, q.path())
+		}
+	}
+	if err != nil {
+		lErr("Could not save queue of jobs: ", err)
+	}
+}
+
+//snapshot copies job, with progress of running one as it is right now. Call with lock held
+func (j *job) snapshot() job {
+	c := *j
+	if j.State == jobRunning {
+		c.Progress = j.view.state()
+	}
+	c.cancel, c.view = nil, nil
+	return c
+}
+
+//add queues new job
+func (q *jobQueue) add(r jobRequest) (job, error) {
+	if err := r.check(); err != nil {
+		return job{}, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := &job{ID: q.next, jobRequest: r, State: jobQueued, Created: time.Now()}
+	q.next++
+	q.jobs = append(q.jobs, j)
+	q.forget()
+	q.save()
+	select {
+	case q.wake <- struct{}{}:
+	default: //Already woken up
+	}
+	lInfo("Queued job", j.ID)
+	return j.snapshot(), nil
+}
+
+//forget drops oldest finished jobs over keepJobs. Call with lock held
+func (q *jobQueue) forget() {
+	over := -keepJobs
+	for _, j := range q.jobs {
+		if j.State == jobFinished || j.State == jobCancelled {
+			over++
+		}
+	}
+	kept := q.jobs[:0]
+	for _, j := range q.jobs {
+		if over > 0 && (j.State == jobFinished || j.State == jobCancelled) {
+			over--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	q.jobs = kept
+}
+
+//find gets job by ID. Call with lock held
+func (q *jobQueue) find(id int) *job {
+	for _, j := range q.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+//get tells how job is doing
+func (q *jobQueue) get(id int) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.find(id)
+	if j == nil {
+		return job{}, false
+	}
+	return j.snapshot(), true
+}
+
+//list tells how all jobs are doing, newest first
+func (q *jobQueue) list() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := make([]job, 0, len(q.jobs))
+	for i := len(q.jobs) - 1; i >= 0; i-- {
+		res = append(res, q.jobs[i].snapshot())
+	}
+	return res
+}
+
+//cancelJob drops queued job or aborts running one. Finished jobs stay as they are
+func (q *jobQueue) cancelJob(id int) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.find(id)
+	if j == nil {
+		return job{}, false
+	}
+	switch j.State {
+	case jobQueued:
+		now := time.Now()
+		j.State, j.Finished = jobCancelled, &now
+		q.save()
+		lInfo("Cancelled job", j.ID)
+	case jobRunning:
+		j.cancel() //Job notes itself as cancelled when it's over
+		lInfo("Cancelling job", j.ID)
+	}
+	return j.snapshot(), true
+}
+
+//take marks oldest queued job as running and returns it, nil when there is none
+func (q *jobQueue) take(cancel context.CancelFunc) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.State != jobQueued {
+			continue
+		}
+		now := time.Now()
+		j.State, j.Started, j.Finished, j.cancel = jobRunning, &now, nil, cancel
+		j.Report = strconv.Itoa(j.ID) + ".report.json"
+		j.view = newProgressView(ioutil.Discard, workers) //Drawn nowhere, it's here to be looked at
+		q.save()
+		return j
+	}
+	return nil
+}
+
+//work runs queued jobs until stop. Stop lets job in progress finish its downloads, abort drops them
+func (q *jobQueue) work(stop, abort context.Context, opts *Options) {
+	for stop.Err() == nil {
+		jobStop, cancelStop := context.WithCancel(stop)
+		jobAbort, cancelAbort := context.WithCancel(abort)
+		j := q.take(func() { cancelStop(); cancelAbort() })
+		if j == nil {
+			cancelStop()
+			cancelAbort()
+			select {
+			case <-q.wake:
+			case <-stop.Done():
+			}
+			continue
+		}
+
+		code := q.run(jobStop, jobAbort, opts, j)
+		cancelled := jobStop.Err() != nil
+		cancelStop()
+		cancelAbort()
+
+		q.mu.Lock()
+		now := time.Now()
+		j.Progress, j.ExitCode, j.cancel, j.view = j.view.state(), code, nil, nil
+		switch {
+		case stop.Err() != nil: //Server goes down, job is done again when it's up
+			j.State, j.Interrupted = jobQueued, true
+		case cancelled:
+			j.State, j.Finished = jobCancelled, &now
+		default:
+			j.State, j.Finished = jobFinished, &now
+		}
+		q.forget()
+		q.save()
+		q.mu.Unlock()
+		lInfo("Job", j.ID, j.State, "with code", code)
+	}
+}
+
+//run runs single job through the same pipeline command line does, with its own report
+func (q *jobQueue) run(stop, abort context.Context, opts *Options, j *job) int {
+	lInfo("Starting job", j.ID)
+	filt, err := parseFilters(j.Filters)
+	if err != nil { //Checked when queued, so only something like broken queue file gets here
+		lErr("Job", j.ID, "has wrong filters: ", err)
+		j.view.close()
+		return exitFatal
+	}
+
+	jo := *opts
+	flags := *opts.FlagOpts
+	flags.Report = filepath.Join(constructFilepath(jobsDir, q.dir), j.Report)
+	jo.FlagOpts = &flags
+	jo.FiltOpts = filt
+	jo.TagOpts = &TagOpts{Tag: j.Tag, StartPage: j.StartPage, StopPage: j.StopPage}
+	if jo.StartPage < 1 {
+		jo.StartPage = 1
+	}
+	if j.Tag != "" && j.Interrupted { //Picking up where it was when server went down
+		if st, err := loadCheckpoint(opts.ImageDir); err == nil && st.Query == j.Tag {
+			jo.TagOpts.resume = st
+		}
+	}
+
+	//Everything that lives for one run starts anew
+	report, filters, checkpoint, progress = newRunReport(), nil, nil, j.view
+
+	code, err := pipeline(stop, abort, &jo, func(stop context.Context, imgdat chan<- Image) {
+		if j.Tag == "" {
+			go ParseImg(stop, imgdat, j.IDs, opts.Key)
+			return
+		}
+		checkpoint = newCheckpoint(opts.ImageDir, j.Tag, jo.TagOpts.resume, false)
+		go ParseTag(stop, imgdat, jo.TagOpts, jo.FiltOpts, opts.Key)
+	})
+	if err != nil { //Server stays up, next job may go better
+		lErr("Job", j.ID, "could not start: ", err)
+		j.view.close()
+	}
+	return code
+}
+
+//writeJSON answers with value as JSON
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v) //Client went away, nothing to do about it
+}
+
+//writeError answers with error as JSON
+func writeError(w http.ResponseWriter, code int, err string) {
+	writeJSON(w, code, map[string]string{"error": err})
+}
+
+//tokenCookie is where browser keeps token, once page was opened with ?token=
+const tokenCookie = "ponydownloader_token"
+
+//serverAuth is token server wants from clients. Empty token lets anyone in
+type serverAuth string
+
+//allowed tells if request carries token, in header or in cookie
+func (a serverAuth) allowed(r *http.Request) bool {
+	if a == "" {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if c, err := r.Cookie(tokenCookie); err == nil && given == "" {
+		given = c.Value
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(a)) == 1
+}
+
+//sameOrigin tells if request came from page of this server, or not from any page at all. Browsers send Origin with everything but plain GET
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+//loopbackHost tells if host names this machine itself. Other site that pointed its name at us with DNS has that name there instead
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+//guard lets through only requests with token, coming from nowhere but page of this server. Without token, only requests
+//that name this machine as loopback are taken. Whatever is posted must be JSON, which forms on other sites can't send
+//without browser asking server first
+func (a serverAuth) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")) //Anything broken is just not JSON
+		switch {
+		case a == "" && !loopbackHost(r.Host):
+			writeError(w, http.StatusForbidden, "without token server is only for localhost")
+		case !sameOrigin(r):
+			writeError(w, http.StatusForbidden, "requests from other sites are not taken")
+		case !a.allowed(r):
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "token is needed")
+		case r.Method == http.MethodPost && mt != "application/json":
+			writeError(w, http.StatusUnsupportedMediaType, "send job as application/json")
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+//login takes token page was opened with and puts it into cookie, so page and everything it asks for carry it
+func (a serverAuth) login(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if a == "" || token == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a)) != 1 {
+			writeError(w, http.StatusUnauthorized, "wrong token")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther) //Token shouldn't stay in address bar and history
+	})
+}
+
+//serverHandler is everything server answers: REST API of queue and page that goes with it
+func serverHandler(q *jobQueue, opts *Options) http.Handler {
+	auth := serverAuth(opts.ServeCmd.Token)
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", auth.guard(q))
+	mux.Handle("/jobs/", auth.guard(q))
+	mux.Handle("/", webHandler(q, opts))
+	return mux
+}
+
+//ServeHTTP is REST API of queue: POST and GET on /jobs, GET and DELETE on /jobs/ID
+func (q *jobQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, q.list())
+		case http.MethodPost:
+			var req jobRequest
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "could not read job: "+err.Error())
+				return
+			}
+			j, err := q.add(req)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			w.Header().Set("Location", "/jobs/"+strconv.Itoa(j.ID))
+			writeJSON(w, http.StatusCreated, j)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	var j job
+	var ok bool
+	switch r.Method {
+	case http.MethodGet:
+		j, ok = q.get(id)
+	case http.MethodDelete:
+		j, ok = q.cancelJob(id)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+//serveCmd takes download jobs over HTTP and runs them one by one until interrupted
+func serveCmd(opts *Options) int {
+	if opts.DryRun || opts.OutputArchive != "" {
+		lFatal("Server downloads into target directory or bucket, without --dry-run or --output-archive")
+	}
+	if opts.UnsafeHTTPS {
+		makeHTTPSUnsafe()
+	}
+	if opts.ImageDir != "" {
+		if err := os.MkdirAll(opts.ImageDir, 0700); err != nil {
+			lFatal(err)
+		}
+	}
+	for _, command := range []string{opts.OnComplete, opts.OnFinish} { //Better now than in the middle of the first job
+		if _, err := splitCommand(command); err != nil {
+			lFatal("Could not understand hook command: ", err)
+		}
+	}
+
+	q, err := loadJobQueue(opts.ImageDir)
+	if err != nil {
+		lFatal("Could not read queue of jobs: ", err)
+	}
+
+	if opts.MetricsAddr != "" {
+		srv, err := serveMetrics(opts.MetricsAddr)
+		if err != nil {
+			lFatal("Could not serve metrics: ", err)
+		}
+		defer srv.Close()
+	}
+
+	ln, err := net.Listen("tcp", opts.ServeCmd.Addr)
+	if err != nil {
+		lFatal("Could not listen: ", err)
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); opts.ServeCmd.Token == "" && (!ok || !addr.IP.IsLoopback()) {
+		lFatal("Server could be reached from other machines at ", ln.Addr(), ", give it --token or listen on localhost")
+	}
+	srv := &http.Server{Handler: serverHandler(q, opts), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			lErr("Server stopped: ", err)
+		}
+	}()
+	lInfo("Taking jobs at", "http://"+ln.Addr().String()+"/jobs", "and showing them at", "http://"+ln.Addr().String()+"/")
+
+	stop, abort := handleInterrupts()
+	q.work(stop, abort, opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = srv.Shutdown(ctx) //Whoever didn't get answer by now won't get it
+	lDone("Server stopped, unfinished jobs are kept for next time")
+	return exitOK
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilters(t *testing.T) {
+	f, err := parseFilters(map[string]string{"score": "100", "types": "png,gif", "max-size": "2MiB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.ScoreF || f.Score != 100 || f.FavesF || !f.Types.has("gif") || f.MaxSize != 2<<20 {
+		t.Errorf("Wrong filters: %+v", f)
+	}
+	for _, bad := range []map[string]string{{"score": "lots"}, {"orientation": "round"}, {"dir": "/etc"}} {
+		if _, err = parseFilters(bad); err == nil {
+			t.Errorf("%v taken for filters", bad)
+		}
+	}
+}
+
+func TestJobQueueAPI(t *testing.T) {
+	dir := t.TempDir()
+	q, err := loadJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(q)
+	defer ts.Close()
+
+	post := func(body string) (*http.Response, job) {
+		resp, err := http.Post(ts.URL+"/jobs", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var j job
+		_ = json.NewDecoder(resp.Body).Decode(&j)
+		return resp, j
+	}
+	for _, bad := range []string{`{}`, `{"tag":"safe","ids":[1]}`, `{"tag":"safe","filters":{"score":"x"}}`, `{"tga":"safe"}`, `nope`} {
+		if resp, _ := post(bad); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", bad, resp.StatusCode)
+		}
+	}
+	resp, first := post(`{"tag":"safe","filters":{"score":"100"}}`)
+	if resp.StatusCode != http.StatusCreated || first.ID != 1 || first.State != jobQueued || resp.Header.Get("Location") != "/jobs/1" {
+		t.Errorf("Wrong answer to new job: %d %+v", resp.StatusCode, first)
+	}
+	_, second := post(`{"ids":[1,2]}`)
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/jobs/2", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if j, _ := q.get(second.ID); resp.StatusCode != http.StatusOK || j.State != jobCancelled {
+		t.Errorf("Job not cancelled: %d %+v", resp.StatusCode, j)
+	}
+	if resp, err = http.Get(ts.URL + "/jobs/9"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Missing job found: %v %v", resp, err)
+	}
+
+	//Server went down in the middle of the first job
+	q.take(func() {})
+	q2, err := loadJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := q2.list()
+	if len(jobs) != 2 || jobs[1].State != jobQueued || !jobs[1].Interrupted || jobs[0].State != jobCancelled || q2.next != 3 {
+		t.Errorf("Queue not restored: %+v", jobs)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	q, err := loadJobQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Config: &Config{ImageDir: q.dir}, FlagOpts: &FlagOpts{}, S3Opts: &S3Opts{}}
+	opts.ServeCmd.Token = "secret"
+	ts := httptest.NewServer(serverHandler(q, opts))
+	defer ts.Close()
+
+	send := func(method, path, contentType string, header ...string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(`{"ids":[1]}`))
+		req.Header.Set("Content-Type", contentType)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req) //Redirects are looked at, not followed
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for _, c := range []struct {
+		method, path, contentType string
+		header                    []string
+		exp                       int
+	}{
+		{http.MethodPost, "/jobs", "application/json", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/jobs", "", []string{"Authorization", "Bearer wrong"}, http.StatusUnauthorized},
+		{http.MethodGet, "/events", "", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/files/1.png", "", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/recent", "", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/history", "", []string{"Authorization", "Bearer secret"}, http.StatusOK},
+		{http.MethodPost, "/jobs", "text/plain", []string{"Authorization", "Bearer secret"}, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/jobs", "application/json", []string{"Authorization", "Bearer secret", "Origin", "http://evil.example"}, http.StatusForbidden},
+		{http.MethodPost, "/jobs", "application/json; charset=utf-8", []string{"Authorization", "Bearer secret", "Origin", ts.URL}, http.StatusCreated},
+		{http.MethodPost, "/jobs", "application/json", []string{"Cookie", tokenCookie + "=secret"}, http.StatusCreated},
+		{http.MethodGet, "/", "", nil, http.StatusOK},
+		{http.MethodGet, "/?token=wrong", "", nil, http.StatusUnauthorized},
+	} {
+		if resp := send(c.method, c.path, c.contentType, c.header...); resp.StatusCode != c.exp {
+			t.Errorf("%s %s %s %v: expected %d, got %d", c.method, c.path, c.contentType, c.header, c.exp, resp.StatusCode)
+		}
+	}
+	resp := send(http.MethodGet, "/?token=secret", "")
+	if cookies := resp.Cookies(); resp.StatusCode != http.StatusSeeOther || len(cookies) != 1 || cookies[0].Value != "secret" || !cookies[0].HttpOnly {
+		t.Errorf("Token is not kept in cookie: %d %v", resp.StatusCode, cookies)
+	}
+}
+
+func TestServerLoopbackOnly(t *testing.T) {
+	q, err := loadJobQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Config: &Config{ImageDir: q.dir}, FlagOpts: &FlagOpts{}, S3Opts: &S3Opts{}}
+	ts := httptest.NewServer(serverHandler(q, opts))
+	defer ts.Close()
+
+	for host, exp := range map[string]int{"": http.StatusOK, "localhost:8080": http.StatusOK, "[::1]:8080": http.StatusOK, "rebound.example:8080": http.StatusForbidden} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/jobs", nil)
+		if host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != exp {
+			t.Errorf("Host %q: expected %d, got %d", host, exp, resp.StatusCode)
+		}
+	}
+}
+
+func TestJobRun(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.json", "/2.json":
+			id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".json")
+			_, _ = w.Write([]byte(`{"id":` + id + `,"image":"` + ts.URL + `/img/x.png","original_format":"png","score":` + id + `0}`))
+		default:
+			_, _ = w.Write([]byte("picture " + r.URL.Path))
+		}
+	}))
+	defer ts.Close()
+	saved, savedReport, savedProgress, savedArchive, savedCatalogue, savedJournal := derpiURL, report, progress, archive, catalogue, journal
+	defer func() {
+		derpiURL, report, progress, filters = saved, savedReport, savedProgress, nil
+		archive, catalogue, journal = savedArchive, savedCatalogue, savedJournal
+	}()
+	u, _ := url.Parse(ts.URL)
+	derpiURL.Scheme, derpiURL.Host = u.Scheme, u.Host
+
+	dir := t.TempDir()
+	opts := &Options{Config: &Config{ImageDir: dir, QDepth: 10}, FlagOpts: &FlagOpts{}, FiltOpts: &FiltOpts{}, MediaOpts: &MediaOpts{Size: "full"},
+		S3Opts: &S3Opts{}, HookOpts: &HookOpts{}, TagOpts: &TagOpts{}}
+	q, err := loadJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := q.add(jobRequest{IDs: []int{1, 2}, Filters: map[string]string{"score": "15"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.work(stop, context.Background(), opts)
+		close(done)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, _ := q.get(j.ID); got.State == jobFinished {
+			break
+		}
+	}
+	opts.OnComplete = "'unfinished" //Job that can't start fails alone, server goes on
+	bad, err := q.add(jobRequest{IDs: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, _ := q.get(bad.ID); got.State == jobFinished {
+			break
+		}
+	}
+	cancel()
+	<-done
+	if got, _ := q.get(bad.ID); got.State != jobFinished || got.ExitCode != exitFatal {
+		t.Errorf("Job that could not start: %+v", got)
+	}
+
+	got, _ := q.get(j.ID)
+	if got.State != jobFinished || got.ExitCode != exitOK || got.Progress.Done != 2 {
+		t.Errorf("Job went wrong: %+v", got)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "2.png")); err != nil {
+		t.Error("Image not downloaded: ", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "1.png")); err == nil {
+		t.Error("Filtered image downloaded")
+	}
+	var r runReport
+	raw, err := ioutil.ReadFile(filepath.Join(dir, jobsDir, got.Report))
+	if err != nil || json.Unmarshal(raw, &r) != nil || r.Totals[outcomeDownloaded] != 1 || r.Totals[outcomeFiltered] != 1 {
+		t.Errorf("Wrong report of job: %s %v", raw, err)
+	}
+}
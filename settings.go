@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	flag "github.com/jessevdk/go-flags"
 )
@@ -19,11 +20,27 @@ type Config struct {
 	QDepth     int    `short:"q" long:"queue" description:"Length of the queue buffer" default:"50" ini-name:"queue_depth"`
 	Key        string `short:"k" long:"key" description:"Derpibooru API key" ini-name:"key"`
 	LogFilters Bool   `long:"logfilter" optional:" " optional-value:"true" description:"Enable logging of filtered images" ini-name:"logfilter"`
+
+	//No defaults in tags for those, or they would override whatever is in config.ini. See setupLogging
+	LogFile    string `long:"log-file" description:"Log file, none to log only on console (default: event.log)" ini-name:"log_file"`
+	LogFormat  string `long:"log-format" description:"Format of log records (default: text)" choice:"text" choice:"json" ini-name:"log_format"`
+	LogLevel   string `long:"log-level" description:"Least important records to log (default: info)" choice:"info" choice:"warn" choice:"error" ini-name:"log_level"`
+	LogMaxSize int    `long:"log-max-size" description:"Rotate log file after it grows over given amount of megabytes (default: 1)" ini-name:"log_max_size"`
+	LogBackups int    `long:"log-backups" description:"How many rotated log files to keep (default: 9)" ini-name:"log_backups"`
+	LogMaxAge  int    `long:"log-max-age" description:"How many days to keep rotated log files (default: 28)" ini-name:"log_max_age"`
 }
 
 //FlagOpts are runtime boolean flags
 type FlagOpts struct {
-	UnsafeHTTPS bool `long:"unsafe-https" description:"Disable HTTPS security verification"`
+	UnsafeHTTPS   bool   `long:"unsafe-https" description:"Disable HTTPS security verification"`
+	DryRun        bool   `long:"dry-run" description:"Only list images that would be downloaded, without downloading them"`
+	ListFormat    string `long:"list-format" description:"Format of image list for dry run" choice:"table" choice:"json" choice:"csv" default:"table"`
+	Report        string `long:"report" description:"Write JSON report of what happened to every image into given file"`
+	MetricsAddr   string `long:"metrics-addr" description:"Serve Prometheus metrics on given address, like :9090"`
+	OutputArchive string `long:"output-archive" description:"Put images into archive instead of target directory, - for stdout"`
+	Format        string `long:"format" description:"Format of archive, guessed by its name when not given" choice:"zip" choice:"tar" choice:"tar.zst"`
+	Manifest      bool   `long:"manifest" description:"Add manifest.jsonl with hashes of all files at the end of archive"`
+	Dedupe        string `long:"dedupe" description:"Link downloaded files to ones with the same content already in target directory, instead of keeping copies" choice:"hardlink" choice:"reflink" choice:"symlink"`
 }
 
 //FiltOpts are filtration parameters
@@ -32,6 +49,44 @@ type FiltOpts struct {
 	Faves  int  `long:"faves" description:"Filter option, minimal amount of people who favored image for it to be downloaded"`
 	ScoreF bool `no-flag:" "`
 	FavesF bool `no-flag:" "`
+
+	MinWidth    int        `long:"min-width" description:"Filter option, minimal width of image in pixels"`
+	MinHeight   int        `long:"min-height" description:"Filter option, minimal height of image in pixels"`
+	Aspect      Aspect     `long:"aspect" description:"Filter option, aspect ratio of image with optional tolerance, like 16:9 or 16:9±0.02"`
+	MaxSize     ByteSize   `long:"max-size" description:"Filter option, maximal size of image file, like 20MiB"`
+	Orientation string     `long:"orientation" description:"Filter option, orientation of image" choice:"landscape" choice:"portrait" choice:"square"`
+	Since       Date       `long:"since" description:"Filter option, only images uploaded since given date, like 2017-12-20 or 7d"`
+	Until       Date       `long:"until" description:"Filter option, only images uploaded until given date, like 2017-12-20 or 7d"`
+	Types       FormatList `long:"types" description:"Filter option, only images of given original formats, like png,jpeg,gif,webm,svg"`
+	SkipSimilar int        `long:"skip-similar" description:"Filter option, skip images that look like something in target directory, within given distance from 1 to 64"`
+}
+
+//MediaOpts decide which files are saved for every image
+type MediaOpts struct {
+	Size         string     `long:"size" description:"Size of image to save, smaller ones are renders made by Derpibooru" choice:"thumb_tiny" choice:"thumb_small" choice:"thumb" choice:"small" choice:"medium" choice:"large" choice:"tall" choice:"full" default:"full"`
+	SVG          string     `long:"svg" description:"For SVG images, save vector original, PNG render or both" choice:"vector" choice:"raster" choice:"both" default:"vector"`
+	AnimatedAlt  FormatList `long:"animated-alt" description:"For animated images, also save alternates in given formats, like gif,mp4"`
+	EmbedMeta    bool       `long:"embed-meta" description:"Embed tags, Derpibooru URL, artist and source into downloaded pictures"`
+	Thumbs       int        `long:"thumbs" description:"Make JPEG thumbnail of every downloaded picture, fitting into given size, like 256, in .thumbs in target directory. WebP thumbnails are not made, there is no WebP encoder in pure Go"`
+	WithComments bool       `long:"with-comments" description:"Save description and comments of every image next to it, as ID.comments.json"`
+	CommentsHTML bool       `long:"comments-html" description:"With --with-comments, also render them as simple page next to image, as ID.comments.html"`
+}
+
+//S3Opts are for putting images into S3-compatible bucket instead of target directory
+type S3Opts struct {
+	S3Bucket   string   `long:"s3-bucket" description:"Put images into given bucket of S3-compatible storage instead of target directory"`
+	S3Endpoint string   `long:"s3-endpoint" description:"Address of S3-compatible storage, like http://localhost:9000" default:"https://s3.amazonaws.com"`
+	S3Prefix   string   `long:"s3-prefix" description:"Prefix added to names of images in bucket, like ponies/"`
+	S3Region   string   `long:"s3-region" description:"Region of bucket" default:"us-east-1"`
+	S3PartSize ByteSize `long:"s3-part-size" description:"Images bigger than that are uploaded in parts of that size, at least 5MiB" default:"16MiB"`
+}
+
+//HookOpts are commands run when images are downloaded and when run is over
+type HookOpts struct {
+	OnComplete  string        `long:"on-complete" description:"Run command for every downloaded image, like 'notify {path} {id}'. Placeholders {path}, {id} and {file} are filled in, details are in PONY_* variables and JSON on stdin"`
+	OnFinish    string        `long:"on-finish" description:"Run command when run is over, like 'mail-me {report}'. Placeholder {report} is filled with path to run report, which is also on stdin"`
+	HookTimeout time.Duration `long:"hook-timeout" description:"Kill hook command that runs longer than that" default:"1m"`
+	HookJobs    int           `long:"hook-jobs" description:"How many --on-complete commands may run at once" default:"2"`
 }
 
 //TagOpts are options relevant to searching by tags
@@ -39,6 +94,9 @@ type TagOpts struct {
 	Tag       string `short:"t" long:"tag" description:"Tag to download"`
 	StartPage int    `short:"p" long:"startpage" description:"Starting page for search" default:"1"`
 	StopPage  int    `short:"n" long:"stoppage" description:"Stopping page for search, default - parse all search pages"`
+	Resume    bool   `long:"resume" description:"Continue search from checkpoint left in target directory by interrupted run"`
+
+	resume *checkpointState //What we continue from, if there is anything
 }
 
 //Options provide program-wide options. At maximum, we got one persistent global and one short-living copy for writing in config file
@@ -46,10 +104,39 @@ type Options struct {
 	*Config
 	*FlagOpts
 	*FiltOpts
+	*MediaOpts
+	*S3Opts
+	*HookOpts
 	*TagOpts
 	Args struct {
-		IDs []int `description:"Image IDs to download" optional:"yes"`
-	} `positional-args:"yes"`
+		IDs []int
+	} `no-flag:"yes"` //Filled from leftover arguments by hand, or command names would be taken as IDs
+
+	RetryFailed struct{} `command:"retry-failed" description:"Retry images that failed to download before, as noted in journal in target directory"`
+	SimilarCmd  struct {
+		Args struct {
+			Target string `positional-arg-name:"id|file" required:"yes"`
+		} `positional-args:"yes"`
+	} `command:"similar" description:"List files in target directory that look like given image or file, within --skip-similar distance or 10"`
+	HydrusCmd struct {
+		Namespaces NameMap `long:"namespaces" description:"Hydrus namespaces for Derpibooru namespaces and tag categories, replacing defaults, like artist=creator,character=character" default:"artist=artist,oc=oc,species=species"`
+		Args       struct {
+			Dir string `positional-arg-name:"dir" required:"yes"`
+		} `positional-args:"yes"`
+	} `command:"export-hydrus" description:"Export images in target directory into Hydrus import folder, with .txt sidecars of tags, without going online"`
+	DatasetCmd DatasetOpts `command:"export-dataset" description:"Export pictures in target directory as dataset for training: captions from tags, train and validation split, manifest with hashes. Pictures smaller than --min-width and --min-height are left out"`
+	GalleryCmd struct {
+		Args struct {
+			Dir string `positional-arg-name:"dir" required:"yes"`
+		} `positional-args:"yes"`
+	} `command:"gallery-html" description:"Make static site out of target directory, with thumbnails, tag pages, image pages and search, that works without any server"`
+	ServeCmd struct {
+		Addr  string `long:"addr" description:"Address to take jobs at" default:"localhost:8080"`
+		Token string `long:"token" env:"PONYDOWNLOADER_TOKEN" description:"Token clients must give to see and change jobs, as Authorization: Bearer header. Page gets it once as ?token= and keeps it in cookie"`
+	} `command:"serve" description:"Take download jobs over HTTP at /jobs and run them one by one into target directory, keeping queue there across restarts"`
+	DedupeCmd struct{} `command:"dedupe" description:"Find files with the same content in target directory and link them together, hardlinks unless --dedupe says otherwise"`
+
+	command string //Name of command given, if any
 }
 
 func getOptions() (opts *Options, args []string) {
@@ -65,9 +152,21 @@ func getOptions() (opts *Options, args []string) {
 	}
 	inisets := *opts.Config //copy value instead of reference - or we will get no results later
 
-	args, err = flag.Parse(opts)
+	parser := flag.NewParser(opts, flag.Default)
+	parser.Usage = "[OPTIONS] [IDs...]"
+	parser.SubcommandsOptional = true //Downloading is what we do by default
+	args, err = parser.Parse()
 	flagsFail(err)
 
+	if parser.Active != nil {
+		opts.command = parser.Active.Name
+	}
+	opts.Args.IDs, args = idsFromArgs(args)
+
+	if err = setupLogging(opts.Config); err != nil {
+		lFatal("Could not set up logging: ", err)
+	}
+
 	dirF := opts.FiltOpts.flagsPresent(os.Args)
 
 	if !dirF && inisets.ImageDir != "" {
@@ -107,6 +206,12 @@ func (sets *Config) prettyWriteIni(inifile io.Writer) error {
 	fmt.Fprintf(tb, "queue_depth \t= %s\n", strconv.Itoa(sets.QDepth))
 	fmt.Fprintf(tb, "downdir \t= %s\n", sets.ImageDir)
 	fmt.Fprintf(tb, "logfilter \t= %t\n", sets.LogFilters)
+	fmt.Fprintf(tb, "log_file \t= %s\n", sets.LogFile)
+	fmt.Fprintf(tb, "log_format \t= %s\n", sets.LogFormat)
+	fmt.Fprintf(tb, "log_level \t= %s\n", sets.LogLevel)
+	fmt.Fprintf(tb, "log_max_size \t= %d\n", sets.LogMaxSize)
+	fmt.Fprintf(tb, "log_backups \t= %d\n", sets.LogBackups)
+	fmt.Fprintf(tb, "log_max_age \t= %d\n", sets.LogMaxAge)
 
 	return tb.Flush() //Returns and passes error upstairs
 }
@@ -119,7 +224,13 @@ func (sets *Config) isEqual(b *Config) bool {
 	if sets.ImageDir == b.ImageDir &&
 		sets.QDepth == b.QDepth &&
 		sets.Key == b.Key &&
-		sets.LogFilters == b.LogFilters {
+		sets.LogFilters == b.LogFilters &&
+		sets.LogFile == b.LogFile &&
+		sets.LogFormat == b.LogFormat &&
+		sets.LogLevel == b.LogLevel &&
+		sets.LogMaxSize == b.LogMaxSize &&
+		sets.LogBackups == b.LogBackups &&
+		sets.LogMaxAge == b.LogMaxAge {
 		return true
 	}
 	return false
@@ -141,14 +252,27 @@ func (opts *FiltOpts) flagsPresent(args []string) bool {
 	return dirF
 }
 
+//idsFromArgs picks image IDs out of arguments, returning whatever doesn't look like ID
+func idsFromArgs(args []string) (ids []int, rest []string) {
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil || id < 0 {
+			rest = append(rest, arg)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
 func flagsFail(err error) {
 	if err != nil {
 		switch err.(*flag.Error).Type {
 		case flag.ErrHelp:
-			os.Exit(0) //Why fall through when asked for help? Just exit with suggestion
+			os.Exit(exitOK) //Why fall through when asked for help? Just exit with suggestion
 		case flag.ErrUnknownFlag:
 			fmt.Println("Use --help to view all available options")
-			os.Exit(0)
+			os.Exit(exitOK)
 		default:
 			lFatal("Can't parse flags: ", err)
 		}
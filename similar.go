@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "image/gif" //Decoders for everything Derpibooru has that could be looked at
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+//defaultSimilarDistance is how different images may be to be still called similar, when nothing else is said
+const defaultSimilarDistance = 10
+
+//dHash is difference hash of image: image is shrunk to 9x8 gray pixels and every bit tells if pixel is darker than
+//its right neighbour. Resized, recompressed and slightly edited copies get hashes that differ in few bits
+func dHash(img image.Image) uint64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	var gray [8][9]float64
+	for y := 0; y < 8; y++ {
+		y0, y1 := cell(b.Min.Y, b.Dy(), y, 8)
+		for x := 0; x < 9; x++ {
+			x0, x1 := cell(b.Min.X, b.Dx(), x, 9)
+			gray[y][x] = meanLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if gray[y][x] < gray[y][x+1] {
+				h |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return h
+}
+
+//cell is i-th of n equal parts of span starting at min, never empty
+func cell(min, span, i, n int) (int, int) {
+	from, to := min+i*span/n, min+(i+1)*span/n
+	if to <= from {
+		to = from + 1
+	}
+	return from, to
+}
+
+//meanLuma is average brightness of rectangle. Big rectangles are sampled, not walked whole, to keep it fast
+func meanLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	sx, sy := (x1-x0+7)/8, (y1-y0+7)/8
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += sy {
+		for x := x0; x < x1; x += sx {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+//hamming is how many bits differ between two hashes
+func hamming(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatDHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func parseDHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+//canDHash tells if file is picture we can decode, by its name
+func canDHash(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+//maxDecodePixels is the biggest picture decoded whole. Bigger ones would take gigabytes of memory, if they are real at all
+const maxDecodePixels = 100 << 20
+
+//decodeLimited decodes picture, unless its header tells it's too big to
+func decodeLimited(r io.Reader) (image.Image, error) {
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &head))
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxDecodePixels {
+		return nil, fmt.Errorf("picture is too big to decode, %dx%d", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(io.MultiReader(&head, r)) //Header is read once again
+	return img, err
+}
+
+//readDHash decodes image and hashes it. For animations, first frame counts
+func readDHash(r io.Reader) (uint64, error) {
+	img, err := decodeLimited(r)
+	if err != nil {
+		return 0, err
+	}
+	return dHash(img), nil
+}
+
+//fileDHash hashes image on disk
+func fileDHash(path string) (uint64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close() //Read-only, nothing to lose
+	return readDHash(in)
+}
+
+//remoteDHash hashes image on server, usually small render of it
+func remoteDHash(ctx context.Context, source string) (uint64, error) {
+	response, err := get(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close() //Read-only, nothing to lose
+	if !okHTTPStatus(response) {
+		return 0, &statusError{response.Status}
+	}
+	return readDHash(response.Body)
+}
+
+//similarMatch is file in archive that looks like what we asked about
+type similarMatch struct {
+	indexEntry
+	Distance int
+}
+
+//similar finds files in archive within given distance from hash, closest first. Files of image with skipID don't count
+func (a *archiveIndex) similar(h uint64, maxDist, skipID int) []similarMatch {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var res []similarMatch
+	for _, e := range a.files {
+		if e.DHash == "" || (skipID != 0 && e.ID == skipID) {
+			continue
+		}
+		eh, err := parseDHash(e.DHash)
+		if err != nil {
+			continue
+		}
+		if d := hamming(h, eh); d <= maxDist {
+			res = append(res, similarMatch{e, d})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Distance != res[j].Distance {
+			return res[i].Distance < res[j].Distance
+		}
+		return res[i].File < res[j].File
+	})
+	return res
+}
+
+//notSimilar is filter predicate for --skip-similar: image passes when its render looks like nothing in archive.
+//Images we can't look at pass as well
+func notSimilar(maxDist int) func(context.Context, Image) bool {
+	return func(ctx context.Context, img Image) bool {
+		if img.Thumb == nil || !canDHash(img.Thumb.Path) {
+			return true
+		}
+		h, err := remoteDHash(ctx, img.Thumb.String())
+		if err != nil {
+			lDetailw("Could not look at image, letting it through", logFields{"image_id": img.Imgid, "error": err})
+			return true
+		}
+		if m := archive.similar(h, maxDist, img.Imgid); len(m) != 0 {
+			lDetailw(fmt.Sprintf("Looks like %s, distance %d", m[0].File, m[0].Distance), logFields{"image_id": img.Imgid, "file": m[0].File})
+			return false
+		}
+		return true
+	}
+}
+
+//similarCmd is similar command: list files in archive that look like given image or file
+func similarCmd(opts *Options) int {
+	maxDist := opts.SkipSimilar
+	if maxDist <= 0 {
+		maxDist = defaultSimilarDistance
+	}
+	a, err := openArchive(opts.ImageDir, "")
+	if err != nil {
+		lFatal("Could not read index of target directory: ", err)
+	}
+
+	target := opts.SimilarCmd.Args.Target
+	hashes, skipID, err := targetDHashes(context.Background(), a, target, opts.Key)
+	if err != nil {
+		lErr("Could not look at ", target, ": ", err)
+		return exitFatal
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range hashes {
+		for _, m := range a.similar(h, maxDist, skipID) {
+			if !seen[m.File] {
+				seen[m.File] = true
+				fmt.Printf("%d\t%d\t%s\n", m.Distance, m.ID, m.File)
+			}
+		}
+	}
+	lDone("Found", len(seen), "similar files")
+	return exitOK
+}
+
+//targetDHashes gets hash of file, or hashes of image by ID, from archive if it's there or from Derpibooru otherwise
+func targetDHashes(ctx context.Context, a *archiveIndex, target, key string) ([]uint64, int, error) {
+	id, err := strconv.Atoi(target)
+	if err != nil {
+		h, err := fileDHash(target)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rel := archivePath(a.dir, filepath.Clean(target)); a.files[rel].ID != 0 {
+			return []uint64{h}, a.files[rel].ID, nil
+		}
+		return []uint64{h}, 0, nil
+	}
+
+	var hashes []uint64
+	for _, e := range a.files {
+		if e.ID != id || e.DHash == "" {
+			continue
+		}
+		if h, err := parseDHash(e.DHash); err == nil {
+			hashes = append(hashes, h)
+		}
+	}
+	if len(hashes) != 0 {
+		return hashes, id, nil
+	}
+
+	dat, err := imageInfo(ctx, id, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	thumb := thumbURL(dat)
+	if thumb == nil {
+		return nil, 0, errors.New("Derpibooru has no render of image to look at")
+	}
+	h, err := remoteDHash(ctx, thumb.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	return []uint64{h}, id, nil
+}
+
+//thumbURL is small render of image, good enough to hash it. Nil if there is none
+func thumbURL(dat RawImage) *url.URL {
+	u, err := url.Parse(dat.Representations["thumb_small"])
+	if err != nil || u.Path == "" {
+		return nil
+	}
+	u.Scheme = derpiURL.Scheme
+	return u
+}
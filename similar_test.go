@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+//testPicture is something with shapes, so hashes have something to notice
+func testPicture(w, h int, invert bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*x + y*3*w/h) * 255 / (w*w + 3*w))
+			if invert {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	big := dHash(testPicture(900, 800, false))
+	small := dHash(testPicture(90, 80, false))
+	other := dHash(testPicture(900, 800, true))
+
+	if d := hamming(big, small); d > 4 {
+		t.Error("Resized image is too far from original: ", d)
+	}
+	if d := hamming(big, other); d < 32 {
+		t.Error("Inverted image is too close to original: ", d)
+	}
+	if h, err := parseDHash(formatDHash(big)); err != nil || h != big {
+		t.Error("Hash doesn't survive being written down: ", err)
+	}
+}
+
+func TestSkipSimilar(t *testing.T) {
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, testPicture(90, 80, false))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	archive = newArchive("", "")
+	defer func() { archive = nil }()
+	archive.put(indexEntry{ID: 1, File: "1.png", DHash: formatDHash(dHash(testPicture(900, 800, false)))})
+	archive.put(indexEntry{ID: 2, File: "2.png", DHash: formatDHash(dHash(testPicture(900, 800, true)))})
+
+	u, _ := url.Parse(ts.URL + "/thumb_small.png")
+	pass := notSimilar(defaultSimilarDistance)
+	if pass(context.Background(), Image{Imgid: 3, Thumb: u}) {
+		t.Error("Similar image is let through")
+	}
+	if !pass(context.Background(), Image{Imgid: 1, Thumb: u}) {
+		t.Error("Image is filtered as similar to itself")
+	}
+	if !pass(context.Background(), Image{Imgid: 4}) {
+		t.Error("Image without render is filtered")
+	}
+
+	m := archive.similar(dHash(testPicture(900, 800, false)), 64, 0)
+	if len(m) != 2 || m[0].File != "1.png" || m[0].Distance != 0 {
+		t.Errorf("Wrong matches: %+v", m)
+	}
+}
+
+func TestDecodeLimited(t *testing.T) {
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, testPicture(64, 32, false))
+	if img, err := decodeLimited(bytes.NewReader(buf.Bytes())); err != nil || img.Bounds().Dx() != 64 {
+		t.Fatal("Small picture not decoded: ", err)
+	}
+
+	//The same picture that claims to be 100000×100000 pixels
+	huge := append([]byte(nil), buf.Bytes()...)
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := decodeLimited(bytes.NewReader(huge)); err == nil {
+		t.Error("Huge picture decoded")
+	}
+}
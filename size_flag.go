@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//ByteSize is amount of bytes, that could be passed as flag in human-readable form,
+//like "20MiB", "512k" or plain "1048576". Suffixes are always binary, same as in fmtbytes
+type ByteSize int64
+
+//byteSuffixes are checked in order, so longer suffixes must go first
+var byteSuffixes = []struct {
+	suffix string
+	mult   float64
+}{
+	{"pib", PiB}, {"tib", TiB}, {"gib", GiB}, {"mib", MiB}, {"kib", KiB},
+	{"pb", PiB}, {"tb", TiB}, {"gb", GiB}, {"mb", MiB}, {"kb", KiB},
+	{"p", PiB}, {"t", TiB}, {"g", GiB}, {"m", MiB}, {"k", KiB},
+	{"b", 1},
+}
+
+//UnmarshalFlag implements flags.Unmarshaler interface for ByteSize
+func (b *ByteSize) UnmarshalFlag(value string) error {
+	v := strings.ToLower(strings.TrimSpace(value))
+	mult := 1.0
+	for _, s := range byteSuffixes {
+		if strings.HasSuffix(v, s.suffix) {
+			mult = s.mult
+			v = strings.TrimSpace(strings.TrimSuffix(v, s.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("`%s' is not a size, try something like \"20MiB\"", value)
+	}
+
+	*b = ByteSize(n * mult)
+	return nil
+}
+
+//MarshalFlag implements flags.Marshaler interface for ByteSize
+func (b ByteSize) MarshalFlag() (string, error) {
+	return strconv.FormatInt(int64(b), 10), nil
+}
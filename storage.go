@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Storage is where downloaded files end up: target directory, archive or S3 bucket
+type Storage interface {
+	//Exists tells if there is such file in storage already
+	Exists(name string) bool
+	//Size is how big file already in storage was when it came from server, 0 if there is no such file
+	Size(name string) int64
+	//Hash is SHA-256 of file already in storage, as it came from server
+	Hash(name string) (string, error)
+	//Create starts new file. It appears in storage only after Commit
+	Create(name string) (Upload, error)
+	//Remove takes file out of storage
+	Remove(name string) error
+	//Close finishes storage, after all files are in
+	Close() error
+}
+
+//Upload is file on its way into storage. Content sits in local file at Path until Commit,
+//so it could be worked on after Close. Size and hash are of what was written, before any such work
+type Upload interface {
+	io.WriteCloser
+	Path() string
+	Commit() error
+	Abort() error //Drops whatever was written, fine to call after Close
+}
+
+//errCantRemove is when storage only ever grows
+var errCantRemove = errors.New("files can't be removed from this storage")
+
+//openStorage decides where images go, by options. Uploads to bucket stop when ctx is done
+func openStorage(ctx context.Context, opts *Options) (Storage, error) {
+	switch {
+	case opts.OutputArchive != "" && opts.S3Bucket != "":
+		return nil, errors.New("images go either into archive or into bucket, not both")
+	case opts.S3Bucket != "":
+		return newS3Storage(ctx, opts.S3Opts, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	case opts.OutputArchive == "":
+		return newDirStorage(opts.ImageDir), nil
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = packFormat(opts.OutputArchive)
+	}
+	if format == "" {
+		return nil, errors.New("can't tell archive format from its name, use --format")
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if opts.OutputArchive != "-" {
+		f, err := os.Create(opts.OutputArchive)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return newPackStorage(out, format, opts.Manifest)
+}
+
+//toDirectory tells if images go into target directory, as opposed to somewhere else
+func toDirectory(opts *Options) bool {
+	return opts.OutputArchive == "" && opts.S3Bucket == ""
+}
+
+//packFormat guesses archive format by file name
+func packFormat(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return "tar.zst"
+	case name == "-":
+		return "tar" //Streams are usually piped into tar
+	}
+	return ""
+}
+
+//dirStorage is target directory, files are written right where they will stay.
+//Every file is noted in index, which may link it to the same one that's already there
+type dirStorage struct {
+	dir string
+}
+
+func newDirStorage(dir string) *dirStorage {
+	return &dirStorage{dir: dir}
+}
+
+func (s *dirStorage) path(name string) string {
+	return constructFilepath(name, s.dir)
+}
+
+func (s *dirStorage) Exists(name string) bool {
+	_, err := os.Lstat(s.path(name))
+	return err == nil
+}
+
+//Size knows about metadata we embedded into file, it doesn't count
+func (s *dirStorage) Size(name string) int64 {
+	if orig := archive.origSize(s.path(name)); orig != 0 {
+		return orig
+	}
+	return getFileSize(s.path(name))
+}
+
+//Hash is taken from index when file is the same as when it was noted there
+func (s *dirStorage) Hash(name string) (string, error) {
+	if h := archive.hash(s.path(name)); h != "" {
+		return h, nil
+	}
+	return hashFile(s.path(name))
+}
+
+//Create writes into temporary file next to target. Old file could be link to another image, writing over it
+//would change that image too, so it's only replaced whole on Commit
+func (s *dirStorage) Create(name string) (Upload, error) {
+	target := s.path(name)
+	f, err := ioutil.TempFile(filepath.Dir(target), filepath.Base(target)+".*.tmp") //And now, THE FILE! New, empty, ready to write
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Chmod(0644); err != nil { //Same as os.Create would give with usual umask, temporary files are private
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	return &dirUpload{file: f, path: f.Name(), target: target, hash: sha256.New()}, nil
+}
+
+func (s *dirStorage) Remove(name string) error {
+	archive.removed(s.path(name))
+	return os.Remove(s.path(name))
+}
+
+func (s *dirStorage) Close() error {
+	return nil
+}
+
+type dirUpload struct {
+	file   *os.File //Not embedded, or io.Copy would go around hashing through ReadFrom
+	path   string   //Where content is written
+	target string   //Where it goes on Commit
+	hash   hash.Hash
+	size   int64
+	closed bool
+}
+
+func (u *dirUpload) Write(p []byte) (int, error) {
+	n, err := u.file.Write(p)
+	u.hash.Write(p[:n]) //Hash never fails
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *dirUpload) Path() string {
+	return u.path
+}
+
+//sum is hash of what was written
+func (u *dirUpload) sum() string {
+	return hex.EncodeToString(u.hash.Sum(nil))
+}
+
+func (u *dirUpload) Close() error {
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	return u.file.Close()
+}
+
+//Commit puts file in place of old one, if there was any, and notes it in index
+func (u *dirUpload) Commit() error {
+	if err := u.Close(); err != nil {
+		_ = u.Abort() //Close error is more interesting
+		return err
+	}
+	if err := os.Rename(u.path, u.target); err != nil {
+		_ = u.Abort()
+		return err
+	}
+	archive.added(fileID(filepath.Base(u.target)), u.target, u.size, u.sum())
+	return nil
+}
+
+//Abort removes half of image, because it is no image. Old file, if there was any, stays as it was
+func (u *dirUpload) Abort() error {
+	cerr := u.Close()
+	if err := os.Remove(u.path); err != nil {
+		return err
+	}
+	return cerr
+}
+
+//tempUpload is content kept in temporary file until storage takes it
+type tempUpload struct {
+	dirUpload
+	commit func(path string, size int64, hash string) error
+}
+
+func newTempUpload(name string, commit func(path string, size int64, hash string) error) (*tempUpload, error) {
+	f, err := ioutil.TempFile("", "ponydownloader-*"+filepath.Ext(name))
+	if err != nil {
+		return nil, err
+	}
+	return &tempUpload{dirUpload: dirUpload{file: f, path: f.Name(), hash: sha256.New()}, commit: commit}, nil
+}
+
+func (u *tempUpload) Commit() error {
+	if err := u.Close(); err != nil {
+		_ = u.Abort() //Close error is more interesting
+		return err
+	}
+	err := u.commit(u.path, u.size, u.sum())
+	if rerr := os.Remove(u.path); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+//thumbQuality is JPEG quality of thumbnails. They are for looking at, not for keeping
+const thumbQuality = 85
+
+//thumbsDir is directory in target directory where thumbnails are kept. Hidden, so it's not taken for images
+const thumbsDir = ".thumbs"
+
+//Thumbnails are made by few workers, from queue long enough that downloads wait only when thumbnails are far behind
+const (
+	thumbWorkers = 2
+	thumbQueue   = 1024
+)
+
+//thumbnailer makes thumbnails of downloaded pictures in background. It is nil when nobody asked for them,
+//all methods are fine with that
+var thumbnailer *thumbMaker
+
+type thumbMaker struct {
+	ctx   context.Context
+	dir   string
+	size  int
+	queue chan string
+	wg    sync.WaitGroup
+}
+
+//newThumbMaker starts workers. Cancelling context makes them drop what's left in queue
+func newThumbMaker(ctx context.Context, dir string, size int) *thumbMaker {
+	t := &thumbMaker{ctx: ctx, dir: dir, size: size, queue: make(chan string, thumbQueue)}
+	for i := 0; i < thumbWorkers; i++ {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			for file := range t.queue {
+				if t.ctx.Err() != nil {
+					continue
+				}
+				src, dst := constructFilepath(file, t.dir), thumbPath(t.dir, file)
+				if thumbFresh(src, dst) {
+					continue
+				}
+				if err := makeThumb(src, dst, t.size); err != nil {
+					lWarn("Could not make thumbnail of", file, err)
+				}
+			}
+		}()
+	}
+	return t
+}
+
+//thumbName is name of thumbnail of file, in thumbnails directory. Extension of picture stays, so 1.png and 1.gif don't share one
+func thumbName(file string) string {
+	return file + ".jpg"
+}
+
+//thumbPath is where thumbnail of file in target directory is
+func thumbPath(dir, file string) string {
+	return filepath.Join(constructFilepath(thumbsDir, dir), filepath.FromSlash(thumbName(file)))
+}
+
+//add queues file in target directory for thumbnail, if it's a picture
+func (t *thumbMaker) add(file string) {
+	if t == nil || !canDHash(file) {
+		return
+	}
+	t.queue <- file
+}
+
+//close waits for thumbnails in queue to be made
+func (t *thumbMaker) close() {
+	if t == nil {
+		return
+	}
+	close(t.queue)
+	t.wg.Wait()
+}
+
+//scaleDown fits picture into size×size square, keeping its proportions. Transparent parts become white,
+//as JPEG has no transparency. Smaller pictures are not scaled up
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+//makeThumb decodes picture and writes its thumbnail as JPEG. For animations, first frame counts
+func makeThumb(src, dst string, size int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	img, err := decodeLimited(in)
+	_ = in.Close() //Read-only, nothing to lose
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = jpeg.Encode(out, scaleDown(img, size), &jpeg.Options{Quality: thumbQuality}); err != nil {
+		_ = out.Close() //Encoding error is more interesting
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+//thumbFresh tells if thumbnail is already there and not older than picture
+func thumbFresh(src, dst string) bool {
+	s, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	d, err := os.Stat(dst)
+	return err == nil && !d.ModTime().Before(s.ModTime())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScaleDown(t *testing.T) {
+	for _, c := range []struct{ w, h, size, ew, eh int }{
+		{1000, 500, 256, 256, 128},
+		{500, 1000, 256, 128, 256},
+		{100, 50, 256, 100, 50},
+		{5000, 2, 256, 256, 1},
+	} {
+		b := scaleDown(image.NewGray(image.Rect(0, 0, c.w, c.h)), c.size).Bounds()
+		if b.Dx() != c.ew || b.Dy() != c.eh {
+			t.Errorf("%dx%d into %d: expected %dx%d, got %dx%d", c.w, c.h, c.size, c.ew, c.eh, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestThumbMaker(t *testing.T) {
+	dir := t.TempDir()
+	f, _ := os.Create(filepath.Join(dir, "1.png"))
+	if err := png.Encode(f, testPicture(600, 300, false)); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	_ = ioutil.WriteFile(filepath.Join(dir, "2.webm"), []byte("video"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "3.png"), []byte("broken"), 0600)
+	f, _ = os.Create(filepath.Join(dir, "1.gif"))
+	if err := gif.Encode(f, testPicture(300, 600, false), nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	tm := newThumbMaker(context.Background(), dir, 64)
+	for _, name := range []string{"1.png", "2.webm", "3.png", "1.gif"} {
+		tm.add(name)
+	}
+	tm.close()
+
+	in, err := os.Open(thumbPath(dir, "1.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	cfg, format, err := image.DecodeConfig(in)
+	if err != nil || format != "jpeg" || cfg.Width != 64 || cfg.Height != 32 {
+		t.Errorf("Wrong thumbnail: %s %dx%d, %v", format, cfg.Width, cfg.Height, err)
+	}
+	if _, err = os.Stat(thumbPath(dir, "1.gif")); err != nil || thumbPath(dir, "1.gif") == thumbPath(dir, "1.png") {
+		t.Error("Pictures with the same ID share thumbnail: ", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, thumbsDir))
+	if len(files) != 2 {
+		t.Errorf("Thumbnails of what isn't picture: %d files", len(files))
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//webFiles is page of server mode, script and style that go with it
+//
+//go:embed web
+var webFiles embed.FS
+
+//recentImages is how many last downloads are shown
+const recentImages = 60
+
+//eventsRefresh is how often jobs are looked at for news to send to pages
+const eventsRefresh = 500 * time.Millisecond
+
+//historyEntry is summary of single run, from its report
+type historyEntry struct {
+	Job          int             `json:"job"`
+	Started      time.Time       `json:"started"`
+	Finished     time.Time       `json:"finished"`
+	ExitCode     int             `json:"exit_code"`
+	Interrupted  bool            `json:"interrupted"`
+	Totals       map[outcome]int `json:"totals"`
+	Bytes        int64           `json:"bytes"`
+	APIErrors    int             `json:"api_errors"`
+	HookFailures int             `json:"hook_failures"`
+}
+
+//recentImage is downloaded file, as shown in grid. Paths are relative to target directory
+type recentImage struct {
+	ID    int    `json:"id"`
+	File  string `json:"file"`
+	Thumb string `json:"thumb,omitempty"` //Empty for videos and others we have nothing to show for
+	Job   int    `json:"job"`
+}
+
+//jobReport is report of job as written, without lock of report that is being filled
+type jobReport struct {
+	job         int
+	Started     time.Time       `json:"started"`
+	Finished    time.Time       `json:"finished"`
+	ExitCode    int             `json:"exit_code"`
+	Interrupted bool            `json:"interrupted"`
+	Totals      map[outcome]int `json:"totals"`
+	Bytes       int64           `json:"bytes"`
+	APIErrors   []string        `json:"api_errors"`
+	Hooks       []hookFailure   `json:"hook_failures"`
+	Images      []imageResult   `json:"images"`
+}
+
+//readReports reads reports of all jobs there were, newest first. Broken ones are skipped
+func readReports(dir string) ([]jobReport, error) {
+	names, err := filepath.Glob(filepath.Join(constructFilepath(jobsDir, dir), "*.report.json"))
+	if err != nil {
+		return nil, err
+	}
+	var reports []jobReport
+	for _, name := range names {
+		id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".report.json"))
+		if err != nil {
+			continue
+		}
+		raw, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		r := jobReport{job: id}
+		if err = json.Unmarshal(raw, &r); err != nil {
+			lWarn("Could not read report of job", id, err)
+			continue
+		}
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Started.After(reports[j].Started) })
+	return reports, nil
+}
+
+//history sums up every run
+func history(reports []jobReport) []historyEntry {
+	res := make([]historyEntry, 0, len(reports))
+	for _, r := range reports {
+		res = append(res, historyEntry{Job: r.job, Started: r.Started, Finished: r.Finished, ExitCode: r.ExitCode, Interrupted: r.Interrupted,
+			Totals: r.Totals, Bytes: r.Bytes, APIErrors: len(r.APIErrors), HookFailures: len(r.Hooks)})
+	}
+	return res
+}
+
+//recent picks last downloaded files that are still in target directory, newest first
+func recent(reports []jobReport, dir string, limit int) []recentImage {
+	res := []recentImage{}
+	seen := make(map[string]bool)
+	for _, r := range reports {
+		for i := len(r.Images) - 1; i >= 0 && len(res) < limit; i-- {
+			img := r.Images[i]
+			if img.Outcome != outcomeDownloaded || seen[img.File] {
+				continue
+			}
+			seen[img.File] = true
+			if _, err := os.Stat(constructFilepath(img.File, dir)); err != nil {
+				continue
+			}
+			ri := recentImage{ID: img.ID, File: img.File, Job: r.job}
+			if thumbFresh(constructFilepath(img.File, dir), thumbPath(dir, img.File)) {
+				ri.Thumb = thumbsDir + "/" + thumbName(img.File)
+			} else if canDHash(img.File) {
+				ri.Thumb = img.File
+			}
+			res = append(res, ri)
+		}
+	}
+	return res
+}
+
+//shownFile tells if file in target directory could be given to pages: images and their thumbnails, nothing we keep for ourselves
+func shownFile(rel string) bool {
+	parts := strings.Split(rel, "/")
+	for i, p := range parts {
+		if p == "" || (strings.HasPrefix(p, ".") && !(i == 0 && p == thumbsDir && len(parts) > 1)) {
+			return false
+		}
+	}
+	return !ownFile(parts[len(parts)-1])
+}
+
+//servedFiles knows which files in target directory pages could get: ones noted in index or catalogue, and thumbnails.
+//Index and catalogue are read again only when they change, as every picture in grid asks
+type servedFiles struct {
+	mu    sync.Mutex
+	dir   string
+	stamp string
+	files map[string]bool
+}
+
+//fileStamp changes every time file does
+func fileStamp(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(fi.ModTime().UnixNano(), fi.Size())
+}
+
+//has tells if file, as path relative to target directory, could be given to pages
+func (s *servedFiles) has(rel string) bool {
+	if !shownFile(rel) {
+		return false
+	}
+	if strings.HasPrefix(rel, thumbsDir+"/") {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamp := fileStamp(constructFilepath(indexName, s.dir)) + "," + fileStamp(constructFilepath(catalogueName, s.dir))
+	if s.files == nil || stamp != s.stamp {
+		s.files, s.stamp = make(map[string]bool), stamp
+		if a, err := openArchive(s.dir, ""); err == nil {
+			for f := range a.files {
+				s.files[f] = true
+			}
+		} else {
+			lWarn("Could not read index of target directory: ", err)
+		}
+		if c, err := readCatalogue(s.dir); err == nil {
+			for _, e := range c.list() {
+				for _, f := range e.Files {
+					s.files[f] = true
+				}
+			}
+		} else {
+			lWarn("Could not read catalogue of target directory: ", err)
+		}
+	}
+	return s.files[rel]
+}
+
+//events sends list of jobs to page every time something about them changes, as Server-Sent Events
+func (q *jobQueue) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	tick := time.NewTicker(eventsRefresh)
+	defer tick.Stop()
+	var last []byte
+	for {
+		raw, err := json.Marshal(q.list())
+		if err != nil {
+			lErr("Could not send jobs: ", err)
+			return
+		}
+		if !bytes.Equal(raw, last) {
+			if _, err = fmt.Fprintf(w, "event: jobs\ndata: %s\n\n", raw); err != nil {
+				return //Page is closed
+			}
+			flusher.Flush()
+			last = raw
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+//webHandler serves page of server mode, with what it asks for: events of jobs, history of runs, recent downloads and their files.
+//Page itself is open to anyone, everything it asks for wants the same token as jobs
+func webHandler(q *jobQueue, opts *Options) http.Handler {
+	auth := serverAuth(opts.ServeCmd.Token)
+	served := &servedFiles{dir: q.dir}
+	mux := http.NewServeMux()
+	static, _ := fs.Sub(webFiles, "web") //Directory is embedded, it's there
+	mux.Handle("/", auth.login(http.FileServer(http.FS(static))))
+	mux.Handle("/events", auth.guard(http.HandlerFunc(q.events))) //Same jobs as /jobs shows
+	mux.Handle("/history", auth.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reports, err := readReports(q.dir)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, history(reports))
+	})))
+	mux.Handle("/recent", auth.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !toDirectory(opts) { //Bucket is somewhere else, we have nothing to show
+			writeJSON(w, http.StatusOK, []recentImage{})
+			return
+		}
+		reports, err := readReports(q.dir)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, recent(reports, q.dir, recentImages))
+	})))
+	mux.Handle("/files/", auth.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(path.Clean(r.URL.Path), "/files/")
+		if !toDirectory(opts) || !served.has(rel) { //Only what we downloaded, nothing else that happens to be in target directory
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, constructFilepath(filepath.FromSlash(rel), q.dir))
+	})))
+	return mux
+}
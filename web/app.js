@@ -0,0 +1,173 @@
+(function () {
+	var form = document.getElementById("job");
+	var jobError = document.getElementById("job-error");
+	var live = document.getElementById("live");
+	var filters = ["score", "faves", "since", "until", "min-width", "min-height", "types", "orientation"];
+	var finished = {};
+
+	function el(tag, text) {
+		var e = document.createElement(tag);
+		if (text !== undefined) {
+			e.textContent = text;
+		}
+		return e;
+	}
+
+	function bytes(n) {
+		var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+		var i = 0;
+		while (n >= 1024 && i < units.length - 1) {
+			n /= 1024;
+			i++;
+		}
+		return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+	}
+
+	function bar(got, size) {
+		var b = el("span");
+		b.className = "bar";
+		var fill = el("div");
+		fill.style.width = (size > 0 ? Math.min(100, 100 * got / size) : 0) + "%";
+		b.appendChild(fill);
+		return b;
+	}
+
+	function getJSON(url, done) {
+		fetch(url).then(function (r) { return r.json(); }).then(done);
+	}
+
+	form.addEventListener("submit", function (ev) {
+		ev.preventDefault();
+		var job = {filters: {}};
+		var tag = form.tag.value.trim();
+		var ids = form.ids.value.split(/[\s,]+/).filter(function (s) { return s !== ""; }).map(Number);
+		if (tag !== "") {
+			job.tag = tag;
+		}
+		if (ids.length !== 0) {
+			job.ids = ids;
+		}
+		if (form.start_page.value !== "") {
+			job.start_page = Number(form.start_page.value);
+		}
+		if (form.stop_page.value !== "") {
+			job.stop_page = Number(form.stop_page.value);
+		}
+		filters.forEach(function (name) {
+			var v = form.elements[name].value.trim();
+			if (v !== "") {
+				job.filters[name] = v;
+			}
+		});
+		jobError.textContent = "";
+		fetch("jobs", {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify(job)})
+			.then(function (r) { return r.json().then(function (body) { return {ok: r.ok, body: body}; }); })
+			.then(function (res) {
+				if (!res.ok) {
+					jobError.textContent = res.body.error;
+					return;
+				}
+				form.reset();
+			});
+	});
+
+	function showJobs(jobs) {
+		var body = document.querySelector("#jobs tbody");
+		body.textContent = "";
+		var newlyDone = false;
+		jobs.forEach(function (job) {
+			var tr = el("tr");
+			tr.appendChild(el("td", job.id));
+			tr.appendChild(el("td", job.tag || "images " + (job.ids || []).join(", ")));
+			tr.appendChild(el("td", job.state + (job.state === "finished" ? ", code " + job.exit_code : "")));
+
+			var td = el("td");
+			var p = job.progress;
+			if (job.state !== "queued") {
+				td.appendChild(bar(p.done, p.total));
+				td.appendChild(document.createTextNode(" " + p.done + "/" + (p.total || "?") + ", " + bytes(p.bytes)));
+			}
+			(p.workers || []).forEach(function (w) {
+				if (!w.file) {
+					return;
+				}
+				var line = el("div");
+				line.className = "worker";
+				line.appendChild(bar(w.got, w.size));
+				line.appendChild(document.createTextNode(" " + w.file + " " + bytes(w.got) + (w.size > 0 ? "/" + bytes(w.size) : "")));
+				td.appendChild(line);
+			});
+			tr.appendChild(td);
+
+			td = el("td");
+			if (job.state === "queued" || job.state === "running") {
+				var cancel = el("button", "Cancel");
+				cancel.addEventListener("click", function () { fetch("jobs/" + job.id, {method: "DELETE"}); });
+				td.appendChild(cancel);
+			} else if (!finished[job.id]) {
+				finished[job.id] = true;
+				newlyDone = true;
+			}
+			tr.appendChild(td);
+			body.appendChild(tr);
+		});
+		if (newlyDone) {
+			loadHistory();
+			loadRecent();
+		}
+	}
+
+	function loadHistory() {
+		getJSON("history", function (runs) {
+			var body = document.querySelector("#history tbody");
+			body.textContent = "";
+			runs.forEach(function (run) {
+				var tr = el("tr");
+				var took = (new Date(run.finished) - new Date(run.started)) / 1000;
+				[run.job, new Date(run.started).toLocaleString(), took.toFixed(0) + " s",
+					run.totals["downloaded"], run.totals["skipped-existing"], run.totals["filtered"], run.totals["failed"],
+					bytes(run.bytes), run.exit_code].forEach(function (v) {
+					tr.appendChild(el("td", v));
+				});
+				body.appendChild(tr);
+			});
+		});
+	}
+
+	function loadRecent() {
+		getJSON("recent", function (images) {
+			var grid = document.getElementById("recent");
+			grid.textContent = "";
+			if (images.length === 0) {
+				grid.appendChild(el("p", "Nothing downloaded yet"));
+			}
+			images.forEach(function (img) {
+				var a = el("a");
+				a.href = "files/" + encodeURI(img.file);
+				a.title = img.file;
+				if (img.thumb) {
+					var pic = el("img");
+					pic.src = "files/" + encodeURI(img.thumb);
+					pic.alt = img.file;
+					pic.loading = "lazy";
+					a.appendChild(pic);
+				} else {
+					a.textContent = img.file;
+				}
+				grid.appendChild(a);
+			});
+		});
+	}
+
+	var events = new EventSource("events");
+	events.addEventListener("jobs", function (ev) {
+		live.textContent = "live";
+		showJobs(JSON.parse(ev.data));
+	});
+	events.onerror = function () {
+		live.textContent = "reconnecting…";
+	};
+
+	loadHistory();
+	loadRecent();
+})();
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShownFile(t *testing.T) {
+	for rel, exp := range map[string]bool{
+		"1.png":               true,
+		"sub/2.gif":           true,
+		".thumbs/1.jpg":       true,
+		".thumbs":             false,
+		".jobs/queue.json":    false,
+		"sub/.thumbs/1.jpg":   false,
+		"failed.jsonl":        false,
+		"1.comments.json":     false,
+		"":                    false,
+		"catalogue.jsonl":     false,
+		"sub/../.jobs/1.json": false,
+	} {
+		if got := shownFile(rel); got != exp {
+			t.Errorf("%q: expected %t, got %t", rel, exp, got)
+		}
+	}
+}
+
+func TestHistoryAndRecent(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, jobsDir), 0700)
+	for _, name := range []string{"1.png", "2.webm", "3.png"} {
+		_ = ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0600)
+	}
+	older, newer := newRunReport(), newRunReport()
+	older.Started = newer.Started.Add(-time.Hour)
+	older.add(Image{Imgid: 1, Filename: "1.png"}, outcomeDownloaded, 1, nil)
+	older.add(Image{Imgid: 4, Filename: "4.png"}, outcomeDownloaded, 1, nil) //Removed since
+	newer.add(Image{Imgid: 2, Filename: "2.webm"}, outcomeDownloaded, 1, nil)
+	newer.add(Image{Imgid: 3, Filename: "3.png"}, outcomeDownloaded, 1, nil)
+	newer.add(Image{Imgid: 5, Filename: "5.png"}, outcomeFiltered, 0, nil)
+	newer.apiError(os.ErrNotExist)
+	_ = older.write(filepath.Join(dir, jobsDir, "1.report.json"))
+	_ = newer.write(filepath.Join(dir, jobsDir, "2.report.json"))
+	_ = ioutil.WriteFile(filepath.Join(dir, jobsDir, "3.report.json"), []byte("broken"), 0600)
+
+	reports, err := readReports(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := history(reports)
+	if len(h) != 2 || h[0].Job != 2 || h[0].Totals[outcomeDownloaded] != 2 || h[0].APIErrors != 1 || h[1].Job != 1 {
+		t.Errorf("Wrong history: %+v", h)
+	}
+
+	r := recent(reports, dir, 10)
+	if len(r) != 3 || r[0].File != "3.png" || r[0].Thumb != "3.png" || r[1].Thumb != "" || r[2].ID != 1 || r[2].Job != 1 {
+		t.Errorf("Wrong recent images: %+v", r)
+	}
+	if r = recent(reports, dir, 1); len(r) != 1 {
+		t.Errorf("Limit not kept: %+v", r)
+	}
+}
+
+func TestWebHandler(t *testing.T) {
+	dir := t.TempDir()
+	q, err := loadJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ioutil.WriteFile(filepath.Join(dir, "1.png"), []byte("picture"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not ours"), 0600)
+	_ = os.MkdirAll(filepath.Join(dir, thumbsDir), 0700)
+	_ = ioutil.WriteFile(thumbPath(dir, "1.png"), []byte("thumbnail"), 0600)
+	c, err := openCatalogue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.noted(Image{Imgid: 1, Filename: "1.png"})
+	_ = c.close()
+	opts := &Options{Config: &Config{ImageDir: dir}, FlagOpts: &FlagOpts{}, S3Opts: &S3Opts{}}
+	ts := httptest.NewServer(webHandler(q, opts))
+	defer ts.Close()
+
+	for path, exp := range map[string]string{"/": "<form id=\"job\">", "/app.js": "EventSource", "/files/1.png": "picture", "/files/.thumbs/1.png.jpg": "thumbnail"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), exp) {
+			t.Errorf("%s: got %d %.100s", path, resp.StatusCode, body)
+		}
+	}
+	for _, path := range []string{"/files/.jobs/queue.json", "/files/notes.txt", "/files/" + catalogueName} {
+		if resp, err := http.Get(ts.URL + path); err != nil || resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s is shown: %v %v", path, resp, err)
+		}
+	}
+
+	if _, err = q.add(jobRequest{Tag: "safe"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != "event: jobs" || !lines.Scan() {
+		t.Fatalf("Wrong event: %q", lines.Text())
+	}
+	var jobs []job
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(lines.Text(), "data: ")), &jobs); err != nil || len(jobs) != 1 || jobs[0].Tag != "safe" {
+		t.Errorf("Wrong jobs in event: %s %v", lines.Text(), err)
+	}
+}